@@ -0,0 +1,337 @@
+package modbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 抓包数据的方向
+const (
+	DirRx = "rx" //收到
+	DirTx = "tx" //发送
+)
+
+// CaptureRecord 抓包记录
+type CaptureRecord struct {
+	Time      time.Time //时间
+	Side      string    //SideServer或SideClient
+	Direction string    //DirRx或DirTx
+	Transport string    //"TCP" or "RTU"
+	Peer      string    //对方地址,TCP为远程地址,RTU为串口地址
+	Bytes     []byte    //原始数据
+}
+
+// Request 是否是请求,从站收到的和客户端发送的是请求
+func (this *CaptureRecord) Request() bool {
+	return (this.Side == SideServer) == (this.Direction == DirRx)
+}
+
+// Frame 解析数据帧,不校验异常码
+func (this *CaptureRecord) Frame() (Frame, error) {
+	if this.Transport == RTU {
+		return DecodeRTU(this.Bytes)
+	}
+	f, err := DecodeTCP(this.Bytes)
+	if _, ok := err.(Control); ok {
+		err = nil
+	}
+	return f, err
+}
+
+// Capture 抓包输出
+type Capture interface {
+	WriteRecord(r *CaptureRecord) error
+}
+
+// SetCapture 设置抓包,收到的请求和发送的响应都会写入
+func (this *Server) SetCapture(c Capture) *Server {
+	this.captureWriter = c
+	return this
+}
+
+// SetCapture 设置抓包,发送的请求和收到的响应都会写入
+func (this *Client) SetCapture(c Capture) *Client {
+	this.captureWriter = c
+	return this
+}
+
+// capture 写入抓包记录,f为请求,bs为读取或写入的数据,失败时输出日志
+func (this *Server) capture(dir string, f Frame, bs []byte) {
+	if this.captureWriter == nil {
+		return
+	}
+	r := &CaptureRecord{Time: time.Now(), Side: SideServer, Direction: dir, Transport: f.Type(), Bytes: bs}
+	if req, ok := f.(*Request); ok {
+		r.Peer, r.Transport = req.Peer, req.Transport
+	}
+	if err := this.captureWriter.WriteRecord(r); err != nil {
+		this.log(LevelWarn, EventError, Field{FieldError, err})
+	}
+}
+
+// capture 写入抓包记录,忽略错误
+func (this *Client) capture(dir string, t time.Time, bs []byte) {
+	if this.captureWriter == nil || bs == nil {
+		return
+	}
+	r := &CaptureRecord{Time: t, Side: SideClient, Direction: dir, Transport: this.model, Bytes: bs}
+	var conn io.ReadWriteCloser
+	switch c := this.conn.(type) {
+	case *tcpTransport:
+		conn = c.conn
+	case *rtuTransport:
+		conn = c.conn
+	}
+	if c, ok := conn.(net.Conn); ok {
+		r.Peer = c.RemoteAddr().String()
+	}
+	this.captureWriter.WriteRecord(r)
+}
+
+// jsonRecord JSONL的一行
+type jsonRecord struct {
+	Time      time.Time `json:"time"`
+	Side      string    `json:"side"`
+	Direction string    `json:"dir"`
+	Transport string    `json:"transport"`
+	Peer      string    `json:"peer,omitempty"`
+	Hex       string    `json:"hex"`
+	Unit      *byte     `json:"unit,omitempty"`
+	Control   *byte     `json:"fc,omitempty"`
+	Data      string    `json:"data,omitempty"`
+}
+
+// JSONLCapture 每条记录输出一行JSON,包含原始数据和解析后的从站地址,功能码和数据
+type JSONLCapture struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLCapture 新建JSONL抓包
+func NewJSONLCapture(w io.Writer) *JSONLCapture {
+	return &JSONLCapture{w: w}
+}
+
+func (this *JSONLCapture) WriteRecord(r *CaptureRecord) error {
+	x := &jsonRecord{
+		Time:      r.Time,
+		Side:      r.Side,
+		Direction: r.Direction,
+		Transport: r.Transport,
+		Peer:      r.Peer,
+		Hex:       hex.EncodeToString(r.Bytes),
+	}
+	if f, err := r.Frame(); err == nil {
+		slave, control := f.GetSlave(), byte(f.GetControl())
+		x.Unit, x.Control, x.Data = &slave, &control, hex.EncodeToString(f.GetData())
+	}
+	bs, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, err = this.w.Write(append(bs, '\n'))
+	return err
+}
+
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapLinkRaw  = 101 //LINKTYPE_RAW,数据以IPv4头开始
+	pcapSnapLen  = 65535
+	pcapPort     = 502
+	pcapHeadSize = 40 //IPv4头和TCP头
+)
+
+// PcapCapture 输出pcap格式,每个数据帧封装成端口502的IPv4/TCP报文,Wireshark可以按Modbus/TCP解析
+// 从站的地址固定为127.0.0.1:502,无法解析为IP的对方地址使用127.0.0.2:49152
+// RTU数据帧需要在Wireshark中手动"Decode As"Modbus RTU
+type PcapCapture struct {
+	mu  sync.Mutex
+	w   io.Writer
+	seq map[string]uint32 //每个方向的TCP序号
+}
+
+// NewPcapCapture 新建pcap抓包,先写入文件头
+func NewPcapCapture(w io.Writer) (*PcapCapture, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapCapture{w: w, seq: make(map[string]uint32)}, nil
+}
+
+func (this *PcapCapture) WriteRecord(r *CaptureRecord) error {
+	remoteIP, remotePort := net.IPv4(127, 0, 0, 2).To4(), uint16(49152)
+	if host, port, err := net.SplitHostPort(r.Peer); err == nil {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			remoteIP = ip
+		}
+		if p, err := strconv.Atoi(port); err == nil {
+			remotePort = uint16(p)
+		}
+	}
+	//从站的端口固定为502
+	serverIP, clientIP, clientPort := net.IPv4(127, 0, 0, 1).To4(), remoteIP, remotePort
+	if r.Side == SideClient {
+		serverIP, clientIP, clientPort = remoteIP, net.IPv4(127, 0, 0, 1).To4(), 49152
+	}
+	srcIP, srcPort, dstIP, dstPort := clientIP, clientPort, serverIP, uint16(pcapPort)
+	if !r.Request() {
+		srcIP, srcPort, dstIP, dstPort = serverIP, pcapPort, clientIP, clientPort
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	flow := srcIP.String() + ":" + strconv.Itoa(int(srcPort)) + ">" + dstIP.String() + ":" + strconv.Itoa(int(dstPort))
+	back := dstIP.String() + ":" + strconv.Itoa(int(dstPort)) + ">" + srcIP.String() + ":" + strconv.Itoa(int(srcPort))
+	seq, ack := this.seq[flow], this.seq[back]
+	this.seq[flow] = seq + uint32(len(r.Bytes))
+
+	packet := make([]byte, pcapHeadSize+len(r.Bytes))
+	ip := packet[:20]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	ip[6] = 0x40 //不分片
+	ip[8] = 64
+	ip[9] = 6 //TCP
+	copy(ip[12:], srcIP)
+	copy(ip[16:], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+	tcp := packet[20:40]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 //PSH,ACK
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF)
+	copy(packet[40:], r.Bytes)
+
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(r.Time.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(r.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(packet)))
+	if _, err := this.w.Write(header); err != nil {
+		return err
+	}
+	_, err := this.w.Write(packet)
+	return err
+}
+
+func ipChecksum(header []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(header[i])<<8 | uint32(header[i+1])
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+// ReadCapture 读取抓包文件,根据文件头自动识别pcap或JSONL
+// pcap中目标端口为502的报文按从站收到的请求处理,数据帧能按TCP解析时为TCP,否则为RTU
+func ReadCapture(r io.Reader) ([]*CaptureRecord, error) {
+	buf := bufio.NewReader(r)
+	head, err := buf.Peek(4)
+	if err == nil && binary.LittleEndian.Uint32(head) == pcapMagic {
+		return readPcap(buf)
+	}
+	return readJSONL(buf)
+}
+
+func readJSONL(r *bufio.Reader) ([]*CaptureRecord, error) {
+	result := []*CaptureRecord(nil)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		x := new(jsonRecord)
+		if err := json.Unmarshal(text, x); err != nil {
+			return nil, errors.New("第" + strconv.Itoa(line) + "行格式错误:" + err.Error())
+		}
+		bs, err := hex.DecodeString(x.Hex)
+		if err != nil {
+			return nil, errors.New("第" + strconv.Itoa(line) + "行数据错误:" + err.Error())
+		}
+		result = append(result, &CaptureRecord{
+			Time:      x.Time,
+			Side:      x.Side,
+			Direction: x.Direction,
+			Transport: x.Transport,
+			Peer:      x.Peer,
+			Bytes:     bs,
+		})
+	}
+	return result, scanner.Err()
+}
+
+func readPcap(r io.Reader) ([]*CaptureRecord, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[20:]) != pcapLinkRaw {
+		return nil, errors.New("不支持的pcap链路类型:" + strconv.Itoa(int(binary.LittleEndian.Uint32(header[20:]))))
+	}
+	result := []*CaptureRecord(nil)
+	for {
+		if _, err := io.ReadFull(r, header[:16]); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+		packet := make([]byte, binary.LittleEndian.Uint32(header[8:]))
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return nil, err
+		}
+		if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != 6 {
+			continue
+		}
+		ipLen := int(packet[0]&0x0F) * 4
+		if len(packet) < ipLen+20 {
+			continue
+		}
+		tcp := packet[ipLen:]
+		tcpLen := int(tcp[12]>>4) * 4
+		if len(tcp) < tcpLen || len(tcp) == tcpLen {
+			continue
+		}
+		src := net.JoinHostPort(net.IP(packet[12:16]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(tcp[0:]))))
+		dst := net.JoinHostPort(net.IP(packet[16:20]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(tcp[2:]))))
+		rec := &CaptureRecord{
+			Time:      time.Unix(int64(binary.LittleEndian.Uint32(header[0:])), int64(binary.LittleEndian.Uint32(header[4:]))*1000),
+			Side:      SideServer,
+			Direction: DirRx,
+			Transport: TCP,
+			Peer:      src,
+			Bytes:     tcp[tcpLen:],
+		}
+		if binary.BigEndian.Uint16(tcp[2:]) != pcapPort {
+			rec.Direction, rec.Peer = DirTx, dst
+		}
+		if _, err := rec.Frame(); err != nil {
+			rec.Transport = RTU
+		}
+		result = append(result, rec)
+	}
+}
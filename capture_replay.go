@@ -0,0 +1,144 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ReplayResult 重放一个请求的结果
+type ReplayResult struct {
+	Request   *CaptureRecord //抓包中的请求
+	Expected  []byte         //抓包中的响应,没有响应时为nil
+	Actual    []byte         //重放得到的响应
+	Err       error          //重放失败的原因
+	Transport string         //Expected和Actual的传输方式,重放客户端时为客户端的类型
+}
+
+// Match 重放的响应和抓包中的响应是否一致,TCP忽略事务号,没有抓到响应时只判断是否成功
+func (this *ReplayResult) Match() bool {
+	if this.Err != nil {
+		return false
+	}
+	if this.Expected == nil {
+		return true
+	}
+	expected, actual := this.Expected, this.Actual
+	if this.Transport == TCP && len(expected) >= 2 && len(actual) >= 2 {
+		expected, actual = expected[2:], actual[2:]
+	}
+	return bytes.Equal(expected, actual)
+}
+
+func (this *ReplayResult) String() string {
+	switch {
+	case this.Err != nil:
+		return fmt.Sprintf("error %X: %v", this.Request.Bytes, this.Err)
+	case this.Match():
+		return fmt.Sprintf("ok    %X >>> %X", this.Request.Bytes, this.Actual)
+	}
+	return fmt.Sprintf("diff  %X >>> %X (expected %X)", this.Request.Bytes, this.Actual, this.Expected)
+}
+
+// replayPairs 找出抓包中的请求和对应的响应(同一来源的下一个响应)
+func replayPairs(records []*CaptureRecord) []*ReplayResult {
+	result := []*ReplayResult(nil)
+	for i, r := range records {
+		if !r.Request() {
+			continue
+		}
+		x := &ReplayResult{Request: r, Transport: r.Transport}
+		for _, next := range records[i+1:] {
+			if next.Side == r.Side && next.Peer == r.Peer {
+				if !next.Request() {
+					x.Expected = next.Bytes
+				}
+				break
+			}
+		}
+		result = append(result, x)
+	}
+	return result
+}
+
+// ReplayServer 把抓包中的请求按顺序交给从站处理,和抓包中的响应比较,用于复现从站的问题
+func ReplayServer(s *Server, records []*CaptureRecord) []*ReplayResult {
+	result := replayPairs(records)
+	for _, x := range result {
+		f, err := x.Request.Frame()
+		if err != nil {
+			x.Err = err
+			continue
+		}
+		buf := new(bytes.Buffer)
+		x.Err = s.handle(&Request{Frame: f, Peer: x.Request.Peer, Transport: x.Request.Transport}, buf)
+		x.Actual = buf.Bytes()
+	}
+	return result
+}
+
+// ReplayClient 通过客户端把抓包中的请求按顺序发送给设备(或模拟设备),和抓包中的响应比较
+// 请求按客户端的类型重新编码,保留原来的从站地址,响应不做校验
+func ReplayClient(ctx context.Context, c *Client, records []*CaptureRecord) []*ReplayResult {
+	result := replayPairs(records)
+	for _, x := range result {
+		x.Transport = c.model
+		if c.conn == nil {
+			x.Err = ErrNoConn
+			continue
+		}
+		f, err := x.Request.Frame()
+		if err != nil {
+			x.Err = err
+			continue
+		}
+		var req []byte
+		switch c.model {
+		case RTU:
+			req = EncodeRTU(f.GetSlave(), f.GetControl(), f.GetData())
+		case TCP:
+			req = EncodeTCP(f.GetSlave(), f.GetControl(), f.GetData())
+		default:
+			x.Err = errors.New("未知Modbus类型:" + c.model)
+			continue
+		}
+		sendCtx, cancel := ctx, context.CancelFunc(func() {})
+		if c.timeout > 0 {
+			sendCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		}
+		x.Actual, _, x.Err = c.conn.send(sendCtx, req)
+		cancel()
+		if x.Err == context.DeadlineExceeded {
+			x.Err = ErrTimeout
+		}
+		if x.Request.Transport != c.model {
+			//类型不同时只能比较解析后的数据
+			x.Expected = reencode(c.model, x.Expected)
+		}
+	}
+	return result
+}
+
+// reencode 把响应按model重新编码
+func reencode(model string, bs []byte) []byte {
+	if bs == nil {
+		return nil
+	}
+	var f Frame
+	var err error
+	if model == RTU {
+		f, err = DecodeTCP(bs)
+		if _, ok := err.(Control); ok {
+			err = nil
+		}
+		if err != nil {
+			return bs
+		}
+		return EncodeRTU(f.GetSlave(), f.GetControl(), f.GetData())
+	}
+	if f, err = DecodeRTU(bs); err != nil {
+		return bs
+	}
+	return EncodeTCP(f.GetSlave(), f.GetControl(), f.GetData())
+}
@@ -0,0 +1,95 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	jsonl, pcap := new(bytes.Buffer), new(bytes.Buffer)
+	pc, err := NewPcapCapture(pcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer().SetCapture(pc)
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listen)
+	c, err := DialTCP(listen.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(time.Second).SetCapture(NewJSONLCapture(jsonl))
+	c.ReadHoldingRegisters(3, 2)
+	c.ReadHoldingRegisters(7, 1)
+	c.Close()
+	s.Shutdown(context.Background())
+
+	for name, buf := range map[string]*bytes.Buffer{"jsonl": jsonl, "pcap": pcap} {
+		records, err := ReadCapture(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(records) != 4 {
+			t.Fatal(name, "期望4条记录,实际", len(records))
+		}
+		if !records[0].Request() || records[1].Request() || records[0].Transport != TCP {
+			t.Errorf("%s %+v", name, records[0])
+		}
+		f, err := records[1].Frame()
+		if err != nil || f.GetControl() != ReadHoldingRegisters || !bytes.Equal(f.GetData(), []byte{4, 0, 3, 0, 4}) {
+			t.Error(name, f, err)
+		}
+
+		//在相同的从站中重放,响应应一致
+		results := ReplayServer(newTestServer(), records)
+		if len(results) != 2 {
+			t.Fatal(name, len(results))
+		}
+		for _, r := range results {
+			if !r.Match() {
+				t.Error(name, r)
+			}
+		}
+		//不同的从站数据,响应不一致
+		if results := ReplayServer(NewServer(), records); results[0].Match() {
+			t.Error(name, "数据不同时不应一致", results[0])
+		}
+	}
+}
+
+func TestReplayClient(t *testing.T) {
+	//分别按RTU和TCP抓包,在两种客户端上重放,响应应一致
+	for _, model := range []string{RTU, TCP} {
+		buf := new(bytes.Buffer)
+		c := pipeRTU(newTestServer(), 1)
+		if model == TCP {
+			c = pipeTCP(newTestServer(), 1)
+		}
+		c.SetTimeout(time.Second).SetCapture(NewJSONLCapture(buf))
+		c.ReadHoldingRegisters(3, 2)
+		c.WriteRegisters(5, 0x1234)
+		c.Close()
+		records, err := ReadCapture(buf)
+		if err != nil {
+			t.Fatal(model, err)
+		}
+		for _, replay := range []*Client{pipeRTU(newTestServer(), 1), pipeTCP(newTestServer(), 1)} {
+			results := ReplayClient(context.Background(), replay.SetTimeout(time.Second), records)
+			if len(results) != 2 {
+				t.Fatal(model, replay.model, len(results))
+			}
+			for _, r := range results {
+				if !r.Match() {
+					t.Error(model, "->", replay.model, r)
+				}
+			}
+			replay.Close()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Tag 点位
+type Tag struct {
+	Name     string   //名称
+	Slave    byte     //从站地址
+	Key      string   //类型 KeyOutputCoils KeyInputCoils KeyInputRegisters KeyHoldingRegisters
+	Address  uint16   //地址
+	Type     DataType //数据类型,线圈固定为TypeBool
+	Order    Order    //字节顺序,默认OrderABCD
+	Length   uint16   //字符串占用的寄存器数量
+	Deadband float64  //死区,数字类型变化超过死区才上报,0表示有变化就上报
+	Percent  bool     //死区按上次上报值的百分比计算
+}
+
+// registers 点位占用的寄存器(线圈)数量
+func (this *Tag) registers() uint16 {
+	if this.isCoil() {
+		return 1
+	}
+	if this.Type == TypeString {
+		return this.Length
+	}
+	return uint16(this.Type.Registers())
+}
+
+func (this *Tag) isCoil() bool {
+	return this.Key == KeyOutputCoils || this.Key == KeyInputCoils
+}
+
+// ChangeEvent 点位变化事件,第一次读取时Old为nil
+type ChangeEvent struct {
+	Tag     *Tag        //添加时保存的点位副本
+	Old     interface{} //上次上报的值
+	New     interface{} //当前值
+	OldRaw  []byte      //上次上报的原始数据,寄存器每个2字节,线圈1字节
+	NewRaw  []byte      //当前原始数据
+	OldTime time.Time   //上次上报的时间
+	Time    time.Time   //当前读取的时间
+}
+
+// tagState 点位上次上报的值
+type tagState struct {
+	raw   []byte
+	value interface{}
+	time  time.Time
+}
+
+// ChangeDetector 变化检测,只上报值有变化的点位
+type ChangeDetector struct {
+	mu       sync.Mutex
+	tags     []*Tag
+	last     map[*Tag]*tagState
+	onChange func(e *ChangeEvent)
+}
+
+// NewChangeDetector 新建变化检测,fn为变化回调
+func NewChangeDetector(fn func(e *ChangeEvent)) *ChangeDetector {
+	return &ChangeDetector{
+		last:     make(map[*Tag]*tagState),
+		onChange: fn,
+	}
+}
+
+// Add 添加点位,保存点位的副本,不修改传入的点位
+func (this *ChangeDetector) Add(tags ...*Tag) error {
+	list := make([]*Tag, 0, len(tags))
+	for _, t := range tags {
+		if pollLimit(t.Key) == 0 {
+			return errors.New("未知点位类型:" + t.Key)
+		}
+		x := *t
+		if x.isCoil() {
+			x.Type = TypeBool
+		}
+		if x.Order == "" {
+			x.Order = OrderABCD
+		}
+		if x.registers() == 0 {
+			return errors.New("点位数据类型错误:" + x.Name)
+		}
+		list = append(list, &x)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.tags = append(this.tags, list...)
+	return nil
+}
+
+// Watch 把点位添加到轮询,轮询结果质量正常时检测变化
+func (this *ChangeDetector) Watch(p *Poller, interval time.Duration) error {
+	this.mu.Lock()
+	groups := make([]*PollGroup, 0, len(this.tags))
+	for _, t := range this.tags {
+		t := t
+		groups = append(groups, &PollGroup{
+			Name:     t.Name,
+			Slave:    t.Slave,
+			Key:      t.Key,
+			Address:  t.Address,
+			Quantity: t.registers(),
+			Interval: interval,
+			OnValue: func(v *PollValue) {
+				if v.Quality == QualityGood {
+					this.update(t, v.Registers, v.Coils, v.Time)
+				}
+			},
+		})
+	}
+	this.mu.Unlock()
+	return p.Add(groups...)
+}
+
+// UpdateRegisters 根据读取到的寄存器检测变化,values从address开始
+func (this *ChangeDetector) UpdateRegisters(slave byte, key string, address uint16, values []uint16, t time.Time) {
+	for _, tag := range this.match(slave, key, address, len(values)) {
+		offset := tag.Address - address
+		this.update(tag, values[offset:offset+tag.registers()], nil, t)
+	}
+}
+
+// UpdateCoils 根据读取到的线圈检测变化,values从address开始
+func (this *ChangeDetector) UpdateCoils(slave byte, key string, address uint16, values []bool, t time.Time) {
+	for _, tag := range this.match(slave, key, address, len(values)) {
+		offset := tag.Address - address
+		this.update(tag, nil, values[offset:offset+1], t)
+	}
+}
+
+// match 查找在读取范围内的点位
+func (this *ChangeDetector) match(slave byte, key string, address uint16, n int) []*Tag {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	result := []*Tag(nil)
+	for _, t := range this.tags {
+		if t.Slave == slave && t.Key == key && t.Address >= address &&
+			int(t.Address)+int(t.registers()) <= int(address)+n {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// update 解析点位的值,和上次上报的值比较,有变化时回调
+func (this *ChangeDetector) update(tag *Tag, registers []uint16, coils []bool, t time.Time) {
+	var raw []byte
+	var value interface{}
+	if tag.isCoil() {
+		if len(coils) != 1 {
+			return
+		}
+		raw, value = []byte{0}, coils[0]
+		if coils[0] {
+			raw[0] = 1
+		}
+	} else {
+		var err error
+		if value, err = DecodeValue(registers, tag.Type, tag.Order); err != nil {
+			return
+		}
+		raw = make([]byte, 0, len(registers)*2)
+		for _, r := range registers {
+			raw = append(raw, byte(r>>8), byte(r))
+		}
+	}
+
+	this.mu.Lock()
+	last := this.last[tag]
+	if last != nil && !changed(tag, last, raw, value) {
+		this.mu.Unlock()
+		return
+	}
+	this.last[tag] = &tagState{raw: raw, value: value, time: t}
+	this.mu.Unlock()
+
+	e := &ChangeEvent{Tag: tag, New: value, NewRaw: raw, Time: t}
+	if last != nil {
+		e.Old, e.OldRaw, e.OldTime = last.value, last.raw, last.time
+	}
+	if this.onChange != nil {
+		this.onChange(e)
+	}
+}
+
+// changed 是否有变化,数字类型按死区判断,其它类型比较原始数据
+func changed(tag *Tag, last *tagState, raw []byte, value interface{}) bool {
+	if !tag.Type.Numeric() || tag.Deadband <= 0 {
+		return !bytes.Equal(last.raw, raw)
+	}
+	old, _ := toFloat(last.value)
+	now, _ := toFloat(value)
+	if math.IsNaN(old) || math.IsNaN(now) {
+		return !bytes.Equal(last.raw, raw)
+	}
+	deadband := tag.Deadband
+	if tag.Percent {
+		deadband = math.Abs(old) * tag.Deadband / 100
+	}
+	return math.Abs(now-old) > deadband
+}
@@ -0,0 +1,46 @@
+package modbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChangeDetector(t *testing.T) {
+	events := []*ChangeEvent(nil)
+	d := NewChangeDetector(func(e *ChangeEvent) { events = append(events, e) })
+	temp := &Tag{Name: "temp", Key: KeyHoldingRegisters, Address: 10, Type: TypeInt16, Deadband: 5}
+	level := &Tag{Name: "level", Key: KeyHoldingRegisters, Address: 11, Type: TypeUint16, Deadband: 10, Percent: true}
+	run := &Tag{Name: "run", Key: KeyOutputCoils, Address: 3}
+	if err := d.Add(temp, level, run); err != nil {
+		t.Fatal(err)
+	}
+	if run.Type != "" || temp.Order != "" {
+		t.Fatal("不应该修改传入的点位", run.Type, temp.Order)
+	}
+
+	now := time.Now()
+	d.UpdateRegisters(0, KeyHoldingRegisters, 10, []uint16{100, 200}, now)
+	d.UpdateCoils(0, KeyOutputCoils, 0, []bool{false, false, false, true}, now)
+	if len(events) != 3 || events[0].Old != nil {
+		t.Fatal("第一次读取应该上报全部点位", len(events))
+	}
+
+	events = nil
+	d.UpdateRegisters(0, KeyHoldingRegisters, 10, []uint16{104, 219}, now.Add(time.Second))
+	d.UpdateCoils(0, KeyOutputCoils, 3, []bool{true}, now.Add(time.Second))
+	if len(events) != 0 {
+		t.Fatal("未超过死区不应该上报", events[0].Tag.Name)
+	}
+
+	d.UpdateRegisters(0, KeyHoldingRegisters, 10, []uint16{106, 221}, now.Add(time.Second*2))
+	d.UpdateCoils(0, KeyOutputCoils, 3, []bool{false}, now.Add(time.Second*2))
+	if len(events) != 3 {
+		t.Fatal("超过死区应该上报", len(events))
+	}
+	if e := events[0]; e.Old != int16(100) || e.New != int16(106) || !e.OldTime.Equal(now) {
+		t.Error("变化事件错误", e.Old, e.New)
+	}
+	if e := events[2]; e.Old != true || e.New != false {
+		t.Error("线圈变化事件错误", e.Old, e.New)
+	}
+}
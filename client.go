@@ -1,174 +1,399 @@
 package modbus
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// DefaultTimeout 默认响应超时时间
+const DefaultTimeout = time.Second * 3
+
+// NewRTU 新建RTU客户端,未设置连接,只能使用Encode,Decode和DecodeData
 func NewRTU(addr byte) Interface {
-	return &client{
-		slave: addr,
-		model: RTU,
+	return &Client{
+		slave:   addr,
+		model:   RTU,
+		timeout: DefaultTimeout,
 	}
 }
 
+// NewTCP 新建TCP客户端,未设置连接,只能使用Encode,Decode和DecodeData
 func NewTCP(addr byte) Interface {
-	return &client{
-		slave: addr,
-		model: TCP,
+	return &Client{
+		slave:   addr,
+		model:   TCP,
+		timeout: DefaultTimeout,
 	}
 }
 
-type client struct {
-	slave byte
-	model string
+// Client Modbus客户端(主站),可并发使用
+// RTU连接按先进先出的顺序逐个请求,TCP连接按事务号匹配响应,可同时发起多个请求
+type Client struct {
+	slave         byte          //从站地址
+	model         string        //类型 "TCP" or "RTU"
+	conn          transport     //通讯连接,为nil时只能编解码
+	timeout       time.Duration //响应超时时间
+	retry         *Retry        //重试策略,nil不重试
+	metrics       Metrics       //指标
+	captureWriter Capture       //抓包
 }
 
-// 1-bit access
+// WriteResult 写请求的响应(回显)
+type WriteResult struct {
+	Control  Control //功能码
+	Address  uint16  //起始地址
+	Quantity uint16  //写入的数量
+	Value    uint16  //写单个线圈(0xFF00或0x0000)或单个寄存器时的值
+	AndMask  uint16  //屏蔽写寄存器的AND屏蔽
+	OrMask   uint16  //屏蔽写寄存器的OR屏蔽
+}
 
-func (this *client) ReadOutputCoils(address, quantity uint16) (results []byte, err error) {
-	if quantity < 1 || quantity > 2000 {
-		return nil, errors.New("超出范围(1-2000):" + strconv.Itoa(int(quantity)))
+// Coil 写单个线圈的值
+func (this *WriteResult) Coil() bool {
+	return this.Value == 0xFF00
+}
+
+// newWriteResult 解析写请求的响应,广播时f为nil,返回nil
+func newWriteResult(f Frame, quantity uint16) *WriteResult {
+	if f == nil {
+		return nil
 	}
-	addressBytes, err := ToBytes(address)
-	if err != nil {
-		return nil, err
+	data := f.GetData()
+	result := &WriteResult{
+		Control:  f.GetControl(),
+		Address:  uint16(data[0])<<8 | uint16(data[1]),
+		Quantity: quantity,
 	}
-	quantityBytes, err := ToBytes(quantity)
-	if err != nil {
-		return nil, err
+	switch f.GetControl() {
+	case WriteCoils, WriteRegisters:
+		result.Value = uint16(data[2])<<8 | uint16(data[3])
+	case WriteMultipleCoils, WriteMultipleRegisters:
+		result.Quantity = uint16(data[2])<<8 | uint16(data[3])
+	case MaskWriteRegisters:
+		result.AndMask = uint16(data[2])<<8 | uint16(data[3])
+		result.OrMask = uint16(data[4])<<8 | uint16(data[5])
+	}
+	return result
+}
+
+// WithSlave 复制一个从站地址为slave的客户端,共用同一个连接
+func (this *Client) WithSlave(slave byte) *Client {
+	x := *this
+	x.slave = slave
+	return &x
+}
+
+// SetTimeout 设置响应超时时间
+func (this *Client) SetTimeout(timeout time.Duration) *Client {
+	this.timeout = timeout
+	return this
+}
+
+// SetRetry 设置重试策略,nil不重试
+func (this *Client) SetRetry(retry *Retry) *Client {
+	this.retry = retry
+	return this
+}
+
+// SetConcurrency 设置TCP连接最多同时进行的事务数量,RTU连接固定为1
+func (this *Client) SetConcurrency(n int) *Client {
+	if c, ok := this.conn.(*tcpTransport); ok {
+		c.setConcurrency(n)
+	}
+	return this
+}
+
+// Close 关闭连接,排队中的请求返回ErrClosed
+func (this *Client) Close() error {
+	if this.conn == nil {
+		return nil
 	}
-	data := append(addressBytes, quantityBytes...)
-	return this.Encode(ReadCoils, data)
+	return this.conn.Close()
+}
+
+// 1-bit access
+
+func (this *Client) ReadOutputCoils(address, quantity uint16) ([]bool, error) {
+	return this.ReadOutputCoilsContext(context.Background(), address, quantity)
+}
+
+func (this *Client) ReadOutputCoilsContext(ctx context.Context, address, quantity uint16) ([]bool, error) {
+	return this.readCoils(ctx, ReadCoils, address, quantity)
+}
+
+func (this *Client) ReadInputCoils(address, quantity uint16) ([]bool, error) {
+	return this.ReadInputCoilsContext(context.Background(), address, quantity)
+}
+
+func (this *Client) ReadInputCoilsContext(ctx context.Context, address, quantity uint16) ([]bool, error) {
+	return this.readCoils(ctx, ReadDiscreteInputs, address, quantity)
 }
 
-func (this *client) ReadInputCoils(address, quantity uint16) (results []byte, err error) {
+// readCoils 读线圈,按请求的数量返回,第一个字节的最低位为第一个线圈
+func (this *Client) readCoils(ctx context.Context, control Control, address, quantity uint16) ([]bool, error) {
 	if quantity < 1 || quantity > 2000 {
 		return nil, errors.New("超出范围(1-2000):" + strconv.Itoa(int(quantity)))
 	}
-	addressBytes, err := ToBytes(address)
-	if err != nil {
-		return nil, err
-	}
-	quantityBytes, err := ToBytes(quantity)
+	f, err := this.request(ctx, control, append(uint16ToBytes(address), uint16ToBytes(quantity)...))
 	if err != nil {
 		return nil, err
 	}
-	data := append(addressBytes, quantityBytes...)
-	return this.Encode(ReadDiscreteInputs, data)
+	return BytesToCoils(f.GetData()[1:], int(quantity)), nil
 }
 
-func (this *client) WriteCoils(address uint16, value bool) (results []byte, err error) {
-	addressBytes, err := ToBytes(address)
-	if err != nil {
-		return nil, err
-	}
+func (this *Client) WriteCoils(address uint16, value bool) (*WriteResult, error) {
+	return this.WriteCoilsContext(context.Background(), address, value)
+}
+
+func (this *Client) WriteCoilsContext(ctx context.Context, address uint16, value bool) (*WriteResult, error) {
 	dataBytes := []byte{0x00, 0x00}
 	if value {
 		dataBytes = []byte{0xFF, 0x00}
 	}
-	data := append(addressBytes, dataBytes...)
-	return this.Encode(WriteCoils, data)
+	data := append(uint16ToBytes(address), dataBytes...)
+	f, err := this.request(ctx, WriteCoils, data)
+	return newWriteResult(f, 1), err
 }
 
-func (this *client) WriteMultipleCoils(address, quantity uint16, value []bool) (results []byte, err error) {
+func (this *Client) WriteMultipleCoils(address, quantity uint16, value []bool) (*WriteResult, error) {
+	return this.WriteMultipleCoilsContext(context.Background(), address, quantity, value)
+}
+
+func (this *Client) WriteMultipleCoilsContext(ctx context.Context, address, quantity uint16, value []bool) (*WriteResult, error) {
 	if quantity > 1968 {
 		return nil, errors.New("超出范围(0-1968):" + strconv.Itoa(int(quantity)))
 	}
-	addressBytes, err := ToBytes(address)
-	if err != nil {
-		return nil, err
-	}
-	quantityBytes, err := ToBytes(quantity)
-	if err != nil {
-		return nil, err
-	}
 	if int(quantity) != len(value) {
 		return nil, errors.New("写入数据长度错误")
 	}
-	data := append(addressBytes, quantityBytes...)
+	data := append(uint16ToBytes(address), uint16ToBytes(quantity)...)
 	data = append(data, CoilsBytes(value)...)
-	return this.Encode(WriteMultipleCoils, data)
+	f, err := this.request(ctx, WriteMultipleCoils, data)
+	return newWriteResult(f, quantity), err
 }
 
 // 16-bit access
 
-func (this *client) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
-	addressBytes, err := ToBytes(address)
-	if err != nil {
-		return nil, err
+func (this *Client) ReadInputRegisters(address, quantity uint16) ([]uint16, error) {
+	return this.ReadInputRegistersContext(context.Background(), address, quantity)
+}
+
+func (this *Client) ReadInputRegistersContext(ctx context.Context, address, quantity uint16) ([]uint16, error) {
+	return this.readRegisters(ctx, ReadInputRegisters, address, quantity)
+}
+
+func (this *Client) ReadHoldingRegisters(address, quantity uint16) ([]uint16, error) {
+	return this.ReadHoldingRegistersContext(context.Background(), address, quantity)
+}
+
+func (this *Client) ReadHoldingRegistersContext(ctx context.Context, address, quantity uint16) ([]uint16, error) {
+	return this.readRegisters(ctx, ReadHoldingRegisters, address, quantity)
+}
+
+// readRegisters 读寄存器
+func (this *Client) readRegisters(ctx context.Context, control Control, address, quantity uint16) ([]uint16, error) {
+	if quantity < 1 || quantity > 125 {
+		return nil, errors.New("超出范围(1-125):" + strconv.Itoa(int(quantity)))
 	}
-	quantityBytes, err := ToBytes(quantity)
+	f, err := this.request(ctx, control, append(uint16ToBytes(address), uint16ToBytes(quantity)...))
 	if err != nil {
 		return nil, err
 	}
-	return this.Encode(ReadInputRegisters, append(addressBytes, quantityBytes...))
+	return BytesToRegisters(f.GetData()[1:]), nil
 }
 
-func (this *client) ReadHoldingRegisters(address, quantity uint16) (results []byte, err error) {
-	addressBytes, err := ToBytes(address)
-	if err != nil {
-		return nil, err
+func (this *Client) WriteRegisters(address, value uint16) (*WriteResult, error) {
+	return this.WriteRegistersContext(context.Background(), address, value)
+}
+
+func (this *Client) WriteRegistersContext(ctx context.Context, address, value uint16) (*WriteResult, error) {
+	data := append(uint16ToBytes(address), uint16ToBytes(value)...)
+	f, err := this.request(ctx, WriteRegisters, data)
+	return newWriteResult(f, 1), err
+}
+
+func (this *Client) WriteMultipleRegisters(address, quantity uint16, value []byte) (*WriteResult, error) {
+	return this.WriteMultipleRegistersContext(context.Background(), address, quantity, value)
+}
+
+func (this *Client) WriteMultipleRegistersContext(ctx context.Context, address, quantity uint16, value []byte) (*WriteResult, error) {
+	if len(value) != int(quantity)*2 {
+		return nil, errors.New("写入数据长度错误")
 	}
-	quantityBytes, err := ToBytes(quantity)
-	if err != nil {
-		return nil, err
+	if quantity > 120 || quantity < 1 {
+		return nil, errors.New("超出寄存器范围(0x0001-0x0078)")
 	}
-	return this.Encode(ReadHoldingRegisters, append(addressBytes, quantityBytes...))
+	data := append(uint16ToBytes(address), uint16ToBytes(quantity)...)
+	data = append(data, 2*byte(quantity))
+	data = append(data, value...)
+	f, err := this.request(ctx, WriteMultipleRegisters, data)
+	return newWriteResult(f, quantity), err
 }
 
-func (this *client) WriteRegisters(address, value uint16) (results []byte, err error) {
-	addressBytes, err := ToBytes(address)
+func (this *Client) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]uint16, error) {
+	return this.ReadWriteMultipleRegistersContext(context.Background(), readAddress, readQuantity, writeAddress, writeQuantity, value)
+}
+
+func (this *Client) ReadWriteMultipleRegistersContext(ctx context.Context, readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]uint16, error) {
+	if readQuantity < 1 || readQuantity > 125 {
+		return nil, errors.New("超出读取范围(1-125):" + strconv.Itoa(int(readQuantity)))
+	}
+	if writeQuantity < 1 || writeQuantity > 121 {
+		return nil, errors.New("超出写入范围(1-121):" + strconv.Itoa(int(writeQuantity)))
+	}
+	if len(value) != int(writeQuantity)*2 {
+		return nil, errors.New("写入数据长度错误")
+	}
+	data := append(uint16ToBytes(readAddress), uint16ToBytes(readQuantity)...)
+	data = append(data, uint16ToBytes(writeAddress)...)
+	data = append(data, uint16ToBytes(writeQuantity)...)
+	data = append(data, 2*byte(writeQuantity))
+	data = append(data, value...)
+	f, err := this.request(ctx, ReadWriteMultipleRegisters, data)
 	if err != nil {
 		return nil, err
 	}
-	valueBytes, err := ToBytes(value)
+	return BytesToRegisters(f.GetData()[1:]), nil
+}
+
+func (this *Client) MaskWriteRegisters(address, andMask, orMask uint16) (*WriteResult, error) {
+	return this.MaskWriteRegistersContext(context.Background(), address, andMask, orMask)
+}
+
+func (this *Client) MaskWriteRegistersContext(ctx context.Context, address, andMask, orMask uint16) (*WriteResult, error) {
+	data := append(uint16ToBytes(address), uint16ToBytes(andMask)...)
+	data = append(data, uint16ToBytes(orMask)...)
+	f, err := this.request(ctx, MaskWriteRegisters, data)
+	return newWriteResult(f, 1), err
+}
+
+func (this *Client) ReadFIFOQueue(address uint16) ([]uint16, error) {
+	return this.ReadFIFOQueueContext(context.Background(), address)
+}
+
+func (this *Client) ReadFIFOQueueContext(ctx context.Context, address uint16) ([]uint16, error) {
+	return nil, errors.New("未实现")
+}
+
+// request 发送请求并等待响应,返回校验通过的响应,广播时返回nil
+// ctx未设置截止时间时,每次请求使用客户端的超时时间,超时返回ErrTimeout
+// 响应校验失败时按重试策略重新请求
+func (this *Client) request(ctx context.Context, control Control, data []byte) (Frame, error) {
+	if this.conn == nil {
+		return nil, ErrNoConn
+	}
+	//读写多个寄存器需要响应读取的值,也不能广播
+	if this.model == RTU && this.slave == 0 && (!isWrite(control) || control == ReadWriteMultipleRegisters) {
+		return nil, errors.New("广播只能用于写请求")
+	}
+	req, err := this.Encode(control, data)
 	if err != nil {
 		return nil, err
 	}
-	data := append(addressBytes, valueBytes...)
-	return this.Encode(WriteRegisters, data)
+	start := time.Now()
+	defer func() {
+		if this.metrics != nil {
+			this.metrics.Request(SideClient, this.slave, control, time.Since(start))
+		}
+	}()
+	attempts := this.retry.attempts(control)
+	for i := 1; ; i++ {
+		result, err := this.exchange(ctx, req)
+		observe(this.metrics, SideClient, err)
+		if err == nil || i >= attempts || !this.retry.retryable(err) {
+			return result, err
+		}
+		timer := time.NewTimer(this.retry.backoff(i))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		if this.metrics != nil {
+			this.metrics.Retry(SideClient)
+		}
+	}
 }
 
-func (this *client) WriteMultipleRegisters(address, quantity uint16, value []byte) (results []byte, err error) {
-	if len(value) != int(quantity)*2 {
-		return nil, errors.New("写入数据长度错误")
+// exchange 发送一次请求,并校验响应
+func (this *Client) exchange(ctx context.Context, req []byte) (Frame, error) {
+	if _, ok := ctx.Deadline(); !ok && this.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.timeout)
+		defer cancel()
 	}
-	if quantity > 120 || quantity < 1 {
-		return nil, errors.New("超出寄存器范围(0x0001-0x0078)")
+	start := time.Now()
+	result, order, err := this.conn.send(ctx, req)
+	if this.captureWriter != nil {
+		this.capture(DirTx, start, sentBytes(this.model, req, order))
+		this.capture(DirRx, time.Now(), result)
 	}
-	addressBytes, err := ToBytes(address)
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeout
+	}
+	if err != nil || result == nil {
+		return nil, err
+	}
+	request, err := this.decode(req)
 	if err != nil {
 		return nil, err
 	}
-	quantityBytes, err := ToBytes(quantity)
+	if f, ok := request.(*TCPFrame); ok {
+		//按实际发送的事务号校验响应
+		binary.BigEndian.PutUint16(f.Order[:], order)
+	}
+	response, err := this.decode(result)
 	if err != nil {
 		return nil, err
 	}
-	data := append(addressBytes, quantityBytes...)
-	data = append(data, 2*byte(quantity))
-	data = append(data, value...)
-	return this.Encode(WriteMultipleRegisters, data)
-}
-
-func (this *client) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) (results []byte, err error) {
-	return nil, errors.New("未实现")
+	if err := Validate(request, response); err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
-func (this *client) MaskWriteRegisters(address, andMask, orMask uint16) (results []byte, err error) {
-	return nil, errors.New("未实现")
+// sentBytes 实际发送的请求,TCP写入发送时的事务号,不修改req
+func sentBytes(model string, req []byte, order uint16) []byte {
+	if model != TCP || len(req) < 2 {
+		return req
+	}
+	bs := CopyBytes(req)
+	binary.BigEndian.PutUint16(bs, order)
+	return bs
 }
 
-func (this *client) ReadFIFOQueue(address uint16) (results []byte, err error) {
-	return nil, errors.New("未实现")
+// decode 解析数据帧,不校验从站地址和异常码
+func (this *Client) decode(bytes []byte) (Frame, error) {
+	switch this.model {
+	case RTU:
+		f, err := DecodeRTU(bytes)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	case TCP:
+		f, err := DecodeTCP(bytes)
+		if _, ok := err.(Control); ok {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	return nil, errors.New("未知Modbus类型:" + this.model)
 }
 
 // Encode													  -crc-
 // RTU 04 00 01 00 04 >>> 					05 04 00 01 00 04 a1 8d
 // TCP 04 00 01 00 04 >>> 01 00 00 00 00 06 05 04 00 01 00 04
-func (this *client) Encode(control Control, data []byte) (result []byte, err error) {
+func (this *Client) Encode(control Control, data []byte) (result []byte, err error) {
 	switch this.model {
 	case RTU:
 		result = EncodeRTU(this.slave, control, data)
@@ -181,7 +406,7 @@ func (this *client) Encode(control Control, data []byte) (result []byte, err err
 }
 
 // Decode 解析响应数据
-func (this *client) Decode(bytes []byte) (frame Frame, err error) {
+func (this *Client) Decode(bytes []byte) (frame Frame, err error) {
 	if len(bytes) == 0 {
 		return nil, errors.New("传感器未链接")
 	}
@@ -195,20 +420,28 @@ func (this *client) Decode(bytes []byte) (frame Frame, err error) {
 		return nil, err
 	}
 	if frame.GetSlave() != this.slave {
-		return nil, fmt.Errorf("请求从站%v和响应从站%v不一致", this.slave, bytes[0])
+		return nil, fmt.Errorf("请求从站%v和响应从站%v不一致", this.slave, frame.GetSlave())
+	}
+	if e := exception(frame.GetControl(), frame.GetData()); e != Success {
+		return nil, e
 	}
 	return
 }
 
-// DecodeData 解析出数据域
+// DecodeData 解析出数据域,读请求的响应去掉字节数,写请求的响应返回回显的数据
 // 050402011048ac >>> 0110
-func (this *client) DecodeData(bytes []byte) ([]byte, error) {
+func (this *Client) DecodeData(bytes []byte) ([]byte, error) {
 	f, err := this.Decode(bytes)
 	if err != nil {
 		return nil, err
 	}
-	if int(f.GetData()[0]) != len(f.GetData()[1:]) {
+	data := f.GetData()
+	switch f.GetControl() {
+	case WriteCoils, WriteRegisters, WriteMultipleCoils, WriteMultipleRegisters, MaskWriteRegisters:
+		return data, nil
+	}
+	if len(data) == 0 || int(data[0]) != len(data[1:]) {
 		return nil, errors.New("数据域长度错误:" + f.HEX())
 	}
-	return f.GetData()[1:], nil
+	return data[1:], nil
 }
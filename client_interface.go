@@ -1,20 +1,28 @@
 package modbus
 
+import "context"
+
+// Interface Modbus客户端,每个方法都有带ctx的版本,ctx取消或超时后立即返回
 type Interface interface {
 	// 1-bit access
 
 	// ReadOutputCoils reads from 1 to 2000 contiguous status of coils in a
-	// remote device and returns coil status.
-	ReadOutputCoils(address, quantity uint16) (results []byte, err error)
+	// remote device and returns exactly quantity coil status, the first
+	// coil is the LSB of the first byte.
+	ReadOutputCoils(address, quantity uint16) (results []bool, err error)
+	ReadOutputCoilsContext(ctx context.Context, address, quantity uint16) (results []bool, err error)
 	// ReadInputCoils reads from 1 to 2000 contiguous status of
 	// discrete inputs in a remote device and returns input status.
-	ReadInputCoils(address, quantity uint16) (results []byte, err error)
+	ReadInputCoils(address, quantity uint16) (results []bool, err error)
+	ReadInputCoilsContext(ctx context.Context, address, quantity uint16) (results []bool, err error)
 	// WriteCoils write a single output to either ON or OFF in a
-	// remote device and returns output value.
-	WriteCoils(address uint16, value bool) (results []byte, err error)
+	// remote device and returns the echoed address and output value.
+	WriteCoils(address uint16, value bool) (results *WriteResult, err error)
+	WriteCoilsContext(ctx context.Context, address uint16, value bool) (results *WriteResult, err error)
 	// WriteMultipleCoils forces each coil in a sequence of coils to either
 	// ON or OFF in a remote device and returns quantity of outputs.
-	WriteMultipleCoils(address, quantity uint16, value []bool) (results []byte, err error)
+	WriteMultipleCoils(address, quantity uint16, value []bool) (results *WriteResult, err error)
+	WriteMultipleCoilsContext(ctx context.Context, address, quantity uint16, value []bool) (results *WriteResult, err error)
 
 	// 16-bit access
 
@@ -35,25 +43,31 @@ type Interface interface {
 	// |异常码 		|1个字节 		|01 或 02 或 03 或 04
 	// ReadInputRegisters reads from 1 to 125 contiguous input registers in
 	// a remote device and returns input registers.
-	ReadInputRegisters(address, quantity uint16) (results []byte, err error)
+	ReadInputRegisters(address, quantity uint16) (results []uint16, err error)
+	ReadInputRegistersContext(ctx context.Context, address, quantity uint16) (results []uint16, err error)
 	// ReadHoldingRegisters reads the contents of a contiguous block of
 	// holding registers in a remote device and returns register value.
-	ReadHoldingRegisters(address, quantity uint16) (results []byte, err error)
+	ReadHoldingRegisters(address, quantity uint16) (results []uint16, err error)
+	ReadHoldingRegistersContext(ctx context.Context, address, quantity uint16) (results []uint16, err error)
 	// WriteRegisters writes a single holding register in a remote
 	// device and returns register value.
-	WriteRegisters(address, value uint16) (results []byte, err error)
+	WriteRegisters(address, value uint16) (results *WriteResult, err error)
+	WriteRegistersContext(ctx context.Context, address, value uint16) (results *WriteResult, err error)
 	// WriteMultipleRegisters writes a block of contiguous registers
 	// (1 to 123 registers) in a remote device and returns quantity of
 	// registers.
-	WriteMultipleRegisters(address, quantity uint16, value []byte) (results []byte, err error)
+	WriteMultipleRegisters(address, quantity uint16, value []byte) (results *WriteResult, err error)
+	WriteMultipleRegistersContext(ctx context.Context, address, quantity uint16, value []byte) (results *WriteResult, err error)
 	// ReadWriteMultipleRegisters performs a combination of one read
 	// operation and one write operation. It returns read registers value.
-	ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) (results []byte, err error)
+	ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) (results []uint16, err error)
+	ReadWriteMultipleRegistersContext(ctx context.Context, readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) (results []uint16, err error)
 	// MaskWriteRegisters modify the contents of a specified holding
 	// register using a combination of an AND mask, an OR mask, and the
 	// register's current contents. The function returns
 	// AND-mask and OR-mask.
-	MaskWriteRegisters(address, andMask, orMask uint16) (results []byte, err error)
+	MaskWriteRegisters(address, andMask, orMask uint16) (results *WriteResult, err error)
+	MaskWriteRegistersContext(ctx context.Context, address, andMask, orMask uint16) (results *WriteResult, err error)
 	//ReadFIFOQueue reads the contents of a First-In-First-Out (FIFO) queue
 	// of register in a remote device and returns FIFO value register.
 	//ReadFIFOQueue(address uint16) (results []byte, err error)
@@ -0,0 +1,76 @@
+package modbus
+
+import (
+	"errors"
+	"time"
+)
+
+// Retry 重试策略
+// 读请求自动重试,写请求(05,06,15,16等)重复执行可能不安全,需要设置Write才会重试
+type Retry struct {
+	Attempts    int                  //最多尝试次数,包含第一次,小于2时不重试
+	Interval    time.Duration        //第一次重试前的等待时间
+	Multiplier  float64              //每次重试等待时间的倍数,小于1时按1
+	MaxInterval time.Duration        //最长等待时间,0表示不限制
+	Write       bool                 //写请求是否重试
+	Retryable   func(err error) bool //是否可以重试,为nil时使用Retryable
+}
+
+// NewRetry 默认的重试策略,最多3次,间隔从100毫秒开始翻倍
+func NewRetry() *Retry {
+	return &Retry{
+		Attempts:    3,
+		Interval:    time.Millisecond * 100,
+		Multiplier:  2,
+		MaxInterval: time.Second * 2,
+	}
+}
+
+// Retryable 默认可以重试的错误,超时,CRC校验错误,从站忙和正在处理
+func Retryable(err error) bool {
+	return IsTimeout(err) ||
+		errors.Is(err, ErrCRC) ||
+		errors.Is(err, DeviceBusy) ||
+		errors.Is(err, DeviceConfirm)
+}
+
+// attempts 请求的最多尝试次数
+func (this *Retry) attempts(control Control) int {
+	if this == nil || this.Attempts < 2 || (isWrite(control) && !this.Write) {
+		return 1
+	}
+	return this.Attempts
+}
+
+// retryable 错误是否可以重试
+func (this *Retry) retryable(err error) bool {
+	if this.Retryable != nil {
+		return this.Retryable(err)
+	}
+	return Retryable(err)
+}
+
+// backoff 第n次重试前的等待时间,n从1开始
+func (this *Retry) backoff(n int) time.Duration {
+	interval := float64(this.Interval)
+	for i := 1; i < n && this.Multiplier > 1; i++ {
+		interval *= this.Multiplier
+		if this.MaxInterval > 0 && interval > float64(this.MaxInterval) {
+			break
+		}
+	}
+	if this.MaxInterval > 0 && interval > float64(this.MaxInterval) {
+		return this.MaxInterval
+	}
+	return time.Duration(interval)
+}
+
+// isWrite 是否是写功能码
+func isWrite(control Control) bool {
+	switch control {
+	case WriteCoils, WriteRegisters, WriteMultipleCoils, WriteMultipleRegisters,
+		MaskWriteRegisters, ReadWriteMultipleRegisters:
+		return true
+	}
+	return false
+}
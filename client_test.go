@@ -0,0 +1,315 @@
+package modbus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer 测试用从站,保持寄存器的值等于地址
+func newTestServer() *Server {
+	s := NewServer()
+	for i := uint16(0); i < 100; i++ {
+		value := [2]byte{byte(i >> 8), byte(i)}
+		s.SetHoldingRegisters(i, ReadWriteRegister{
+			Read: func() ([2]byte, error) { return value, nil },
+		})
+	}
+	return s
+}
+
+// pipeTCP 通过内存管道连接TCP客户端和从站
+func pipeTCP(s *Server, slave byte) *Client {
+	c, err := s.PipeTCP(slave)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// pipeRTU 通过内存管道连接RTU客户端和从站
+func pipeRTU(s *Server, slave byte) *Client {
+	c, err := s.PipeRTU(slave, nil)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func TestClientConcurrent(t *testing.T) {
+	s := newTestServer()
+	for _, c := range []*Client{pipeTCP(s, 1).SetConcurrency(4), pipeRTU(s, 1)} {
+		wg := sync.WaitGroup{}
+		for i := uint16(0); i < 50; i++ {
+			wg.Add(1)
+			go func(address uint16) {
+				defer wg.Done()
+				registers, err := c.ReadHoldingRegisters(address, 1)
+				if err != nil {
+					t.Error(c.model, err)
+					return
+				}
+				if registers[0] != address {
+					t.Errorf("[%s] 地址%d 读取到%d", c.model, address, registers[0])
+				}
+			}(i)
+		}
+		wg.Wait()
+		c.Close()
+	}
+}
+
+func TestClientTCPUnitZero(t *testing.T) {
+	c := pipeTCP(newTestServer(), 0)
+	defer c.Close()
+	c.SetTimeout(time.Second)
+	//TCP不支持广播,单元标识0也等待响应
+	if v, err := c.ReadHoldingRegisters(7, 1); err != nil || len(v) != 1 || v[0] != 7 {
+		t.Fatal(v, err)
+	}
+	if r, err := c.WriteRegisters(7, 1); err != nil || r == nil {
+		t.Fatal(r, err)
+	}
+}
+
+func TestClientSendUnchanged(t *testing.T) {
+	c := pipeTCP(newTestServer(), 1)
+	defer c.Close()
+	req := EncodeTCP(1, ReadHoldingRegisters, []byte{0, 3, 0, 1})
+	origin := CopyBytes(req)
+	for i := 0; i < 2; i++ {
+		resp, order, err := c.conn.send(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(req, origin) {
+			t.Fatal("发送时不能修改请求", req)
+		}
+		if binary.BigEndian.Uint16(resp) != order {
+			t.Error("响应的事务号应等于返回的事务号", resp, order)
+		}
+	}
+}
+
+func TestClientBroadcast(t *testing.T) {
+	c := pipeRTU(newTestServer(), 0)
+	defer c.Close()
+	if _, err := c.ReadWriteMultipleRegisters(1, 1, 2, 1, []byte{0, 1}); err == nil {
+		t.Error("读写多个寄存器不能广播")
+	}
+	if _, err := c.ReadHoldingRegisters(1, 1); err == nil {
+		t.Error("读请求不能广播")
+	}
+	if r, err := c.WriteRegisters(1, 1); err != nil || r != nil {
+		t.Error("广播写不等待响应", r, err)
+	}
+}
+
+func TestClientQueueCancel(t *testing.T) {
+	//从站不响应,排队中的请求取消后立即返回
+	c, conn := net.Pipe()
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	client := NewRTUClient(1, c)
+	defer client.Close()
+	req := EncodeRTU(1, ReadHoldingRegisters, []byte{0, 0, 0, 1})
+
+	go client.conn.send(context.Background(), req)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := client.conn.send(ctx, req)
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("取消排队中的请求未返回")
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	//第一个请求延迟响应,取消后迟到的响应不能影响下一个请求
+	c, conn := net.Pipe()
+	defer conn.Close()
+	s := newTestServer()
+	go func() {
+		buf := bufio.NewReader(conn)
+		for i := 0; ; i++ {
+			f, err := ReadWithRTU(buf)
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				time.Sleep(time.Millisecond * 30)
+			}
+			s.handle(f, conn)
+		}
+	}()
+	client := NewRTUClient(1, c)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err := client.ReadHoldingRegistersContext(ctx, 1, 1)
+	if err != ErrTimeout || !IsTimeout(err) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("期望超时错误:", err)
+	}
+
+	registers, err := client.ReadHoldingRegisters(2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registers[0] != 2 {
+		t.Errorf("读取到迟到的响应:%v", registers)
+	}
+}
+
+// pipeBusy 前busy次请求响应从站忙,之后正常响应
+func pipeBusy(busy int) (*Client, *int) {
+	c, conn := net.Pipe()
+	count := 0
+	go func() {
+		defer conn.Close()
+		for {
+			bs, err := readTCP(conn)
+			if err != nil {
+				return
+			}
+			count++
+			if count <= busy {
+				conn.Write([]byte{bs[0], bs[1], 0, 0, 0, 3, bs[6], bs[7] | 0x80, 0x06})
+				continue
+			}
+			f, _ := DecodeTCP(bs)
+			newTestServer().handle(f, conn)
+		}
+	}()
+	return NewTCPClient(1, c), &count
+}
+
+func TestClientRetry(t *testing.T) {
+	retry := &Retry{Attempts: 3, Interval: time.Millisecond}
+
+	c, count := pipeBusy(2)
+	if _, err := c.SetRetry(retry).ReadHoldingRegisters(1, 1); err != nil {
+		t.Error(err)
+	}
+	if *count != 3 {
+		t.Error("期望请求3次,实际", *count)
+	}
+	c.Close()
+
+	c, count = pipeBusy(5)
+	if _, err := c.SetRetry(retry).ReadHoldingRegisters(1, 1); err != DeviceBusy {
+		t.Error("期望从站忙,实际", err)
+	}
+	c.Close()
+
+	//写请求默认不重试
+	c, count = pipeBusy(1)
+	if _, err := c.SetRetry(retry).WriteRegisters(1, 1); err != DeviceBusy || *count != 1 {
+		t.Error("写请求不应该重试", err, *count)
+	}
+	c.Close()
+}
+
+func TestValidate(t *testing.T) {
+	req := &RTUFrame{Slave: 1, Control: WriteRegisters, Data: []byte{0, 1, 0, 5}}
+	for _, c := range []struct {
+		resp *RTUFrame
+		err  error
+	}{
+		{&RTUFrame{Slave: 1, Control: WriteRegisters, Data: []byte{0, 1, 0, 5}}, nil},
+		{&RTUFrame{Slave: 2, Control: WriteRegisters, Data: []byte{0, 1, 0, 5}}, ErrMismatchSlave},
+		{&RTUFrame{Slave: 1, Control: ReadHoldingRegisters, Data: []byte{2, 0, 5}}, ErrMismatchControl},
+		{&RTUFrame{Slave: 1, Control: WriteRegisters, Data: []byte{0, 1, 0, 6}}, ErrMismatchEcho},
+		{&RTUFrame{Slave: 1, Control: WriteRegisters | 0x80, Data: []byte{2}}, IllegalAddress},
+	} {
+		if err := Validate(req, c.resp); !errors.Is(err, c.err) {
+			t.Errorf("%x 期望%v,实际%v", c.resp.Bytes(), c.err, err)
+		}
+	}
+
+	req = &RTUFrame{Slave: 1, Control: ReadCoils, Data: []byte{0, 0, 0, 10}}
+	err := Validate(req, &RTUFrame{Slave: 1, Control: ReadCoils, Data: []byte{1, 0xFF}})
+	e := (*ResponseError)(nil)
+	if !errors.As(err, &e) || e.Err != ErrMismatchLength || e.Request != req {
+		t.Error("期望数据长度不一致", err)
+	}
+
+	//写请求的响应没有字节数
+	c := NewRTU(1)
+	data, err := c.DecodeData(EncodeRTU(1, WriteRegisters, []byte{0, 1, 0, 5}))
+	if err != nil || len(data) != 4 {
+		t.Error(data, err)
+	}
+}
+
+func TestClientTyped(t *testing.T) {
+	s := newTestServer()
+	coils := make([]bool, 10)
+	for i := range coils {
+		i := i
+		s.SetCoils(uint16(i), ReadWriteCoils{
+			Read:  func() (bool, error) { return coils[i], nil },
+			Write: func(b bool) error { coils[i] = b; return nil },
+		})
+	}
+	coils[1], coils[8] = true, true
+	c := pipeRTU(s, 1)
+	defer c.Close()
+
+	list, err := c.ReadOutputCoils(0, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 9 || list[0] || !list[1] || !list[8] {
+		t.Error("线圈顺序错误", list)
+	}
+
+	result, err := c.WriteRegisters(3, 0x1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Control != WriteRegisters || result.Address != 3 || result.Value != 0x1234 {
+		t.Errorf("写寄存器响应错误:%+v", result)
+	}
+
+	if _, err := NewRTU(1).ReadHoldingRegisters(0, 1); err != ErrNoConn {
+		t.Error("未设置连接", err)
+	}
+}
+
+func BenchmarkClientRoundTrip(b *testing.B) {
+	s := newTestServer()
+	for _, c := range []*Client{pipeTCP(s, 1), pipeRTU(s, 1)} {
+		b.Run(c.model, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.ReadHoldingRegisters(1, 10); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		c.Close()
+	}
+}
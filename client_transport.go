@@ -0,0 +1,460 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+var (
+	// ErrClosed 连接已关闭
+	ErrClosed = errors.New("连接已关闭")
+
+	// ErrNoConn 未设置连接,NewRTU和NewTCP新建的客户端只能编解码
+	ErrNoConn = errors.New("未设置连接")
+
+	// ErrTimeout 响应超时,errors.Is(ErrTimeout, context.DeadlineExceeded) 也成立
+	ErrTimeout error = timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "响应超时" }
+
+func (timeoutError) Timeout() bool { return true }
+
+func (timeoutError) Is(err error) bool { return err == context.DeadlineExceeded }
+
+// IsTimeout 是否是超时错误
+func IsTimeout(err error) bool {
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+	var e interface{ Timeout() bool }
+	return errors.As(err, &e) && e.Timeout()
+}
+
+const (
+	// DefaultQueueSize RTU请求队列默认长度,队列满时请求阻塞等待
+	DefaultQueueSize = 32
+
+	// DefaultSilent RTU请求取消后,丢弃残余数据的静默时间
+	DefaultSilent = time.Millisecond * 50
+)
+
+// transport 通讯连接,发送请求帧并返回完整的响应帧,不修改req
+// order为TCP实际发送的事务号,RTU为0
+type transport interface {
+	send(ctx context.Context, req []byte) (resp []byte, order uint16, err error)
+	watch(m Metrics) //记录连接数量,同一连接只记录一次
+	Close() error
+}
+
+// NewRTUClient 新建RTU客户端,conn可以是串口或者RTU over TCP的连接
+func NewRTUClient(slave byte, conn io.ReadWriteCloser) *Client {
+	return &Client{
+		slave:   slave,
+		model:   RTU,
+		conn:    newRTUTransport(conn, DefaultQueueSize),
+		timeout: DefaultTimeout,
+	}
+}
+
+// NewTCPClient 新建TCP客户端
+func NewTCPClient(slave byte, conn io.ReadWriteCloser) *Client {
+	return &Client{
+		slave:   slave,
+		model:   TCP,
+		conn:    newTCPTransport(conn, 1),
+		timeout: DefaultTimeout,
+	}
+}
+
+// DialTCP 连接Modbus TCP从站,例 "192.168.1.10:502"
+func DialTCP(address string, slave byte) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPClient(slave, conn), nil
+}
+
+// DialRTUOverTCP 通过TCP透传连接Modbus RTU从站
+func DialRTUOverTCP(address string, slave byte) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewRTUClient(slave, conn), nil
+}
+
+// DialRTU 打开串口连接Modbus RTU从站
+func DialRTU(cfg *serial.Config, slave byte) (*Client, error) {
+	conn, err := serial.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewRTUClient(slave, conn), nil
+}
+
+// transaction 一次请求
+type transaction struct {
+	ctx    context.Context
+	req    []byte
+	result chan transactionResult
+}
+
+type transactionResult struct {
+	bytes []byte
+	err   error
+}
+
+// rtuTransport RTU是半双工总线,所有请求进入队列,按先进先出的顺序逐个发送
+type rtuTransport struct {
+	conn      io.ReadWriteCloser
+	queue     chan *transaction //请求队列
+	read      chan []byte       //读取到的数据
+	readErr   error             //读取错误,read关闭后有效
+	silent    time.Duration     //静默时间
+	gauge     connGauge
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRTUTransport(conn io.ReadWriteCloser, queueSize int) *rtuTransport {
+	t := &rtuTransport{
+		conn:   conn,
+		queue:  make(chan *transaction, queueSize),
+		read:   make(chan []byte, 16),
+		silent: DefaultSilent,
+		closed: make(chan struct{}),
+	}
+	go t.runRead()
+	go t.runWrite()
+	return t
+}
+
+func (this *rtuTransport) send(ctx context.Context, req []byte) ([]byte, uint16, error) {
+	t := &transaction{ctx: ctx, req: req, result: make(chan transactionResult, 1)}
+	//队列满时阻塞,直到有空位或者请求取消
+	select {
+	case this.queue <- t:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case <-this.closed:
+		return nil, 0, ErrClosed
+	}
+	select {
+	case r := <-t.result:
+		return r.bytes, 0, r.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case <-this.closed:
+		return nil, 0, ErrClosed
+	}
+}
+
+func (this *rtuTransport) watch(m Metrics) { this.gauge.watch(m, this.closed) }
+
+func (this *rtuTransport) Close() error {
+	err := ErrClosed
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		err = this.conn.Close()
+	})
+	return err
+}
+
+// runWrite 逐个处理队列中的请求
+func (this *rtuTransport) runWrite() {
+	for {
+		select {
+		case <-this.closed:
+			return
+		case t := <-this.queue:
+			if err := t.ctx.Err(); err != nil {
+				//排队时已经取消的请求,不再发送
+				t.result <- transactionResult{err: err}
+				continue
+			}
+			bytes, err := this.exchange(t.ctx, t.req)
+			t.result <- transactionResult{bytes: bytes, err: err}
+		}
+	}
+}
+
+// runRead 持续读取数据,串口读取超时不算错误
+func (this *rtuTransport) runRead() {
+	defer close(this.read)
+	buf := make([]byte, 256)
+	for {
+		n, err := this.conn.Read(buf)
+		if n > 0 {
+			select {
+			case this.read <- CopyBytes(buf[:n]):
+			case <-this.closed:
+				return
+			}
+		}
+		if err != nil {
+			if err == serial.ErrTimeout {
+				continue
+			}
+			this.readErr = err
+			return
+		}
+	}
+}
+
+// exchange 发送一帧数据,并读取一帧响应
+func (this *rtuTransport) exchange(ctx context.Context, req []byte) ([]byte, error) {
+	this.discard()
+	if _, err := this.conn.Write(req); err != nil {
+		return nil, err
+	}
+	if len(req) > 0 && req[0] == 0 {
+		//广播,从站不响应
+		return nil, nil
+	}
+	var bytes []byte
+	for {
+		select {
+		case <-ctx.Done():
+			//响应可能在之后到达,等待总线静默,避免影响下一个请求
+			this.resync()
+			return nil, ctx.Err()
+		case <-this.closed:
+			return nil, ErrClosed
+		case bs, ok := <-this.read:
+			if !ok {
+				return nil, this.readErr
+			}
+			bytes = append(bytes, bs...)
+			if n := rtuFrameLength(bytes); n > 0 && len(bytes) >= n {
+				return bytes[:n], nil
+			}
+		}
+	}
+}
+
+// discard 丢弃已经读取到的残余数据
+func (this *rtuTransport) discard() {
+	for {
+		select {
+		case _, ok := <-this.read:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// resync 丢弃数据,直到总线静默
+func (this *rtuTransport) resync() {
+	timer := time.NewTimer(this.silent)
+	defer timer.Stop()
+	for {
+		select {
+		case <-this.closed:
+			return
+		case <-timer.C:
+			return
+		case _, ok := <-this.read:
+			if !ok {
+				return
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(this.silent)
+		}
+	}
+}
+
+// rtuFrameLength 根据功能码计算RTU响应帧的长度,数据不足时返回0
+func rtuFrameLength(bytes []byte) int {
+	if len(bytes) < 2 {
+		return 0
+	}
+	switch control := Control(bytes[1]); {
+	case control.Byte() > 0x80:
+		return 5
+	case control == ReadCoils, control == ReadDiscreteInputs,
+		control == ReadHoldingRegisters, control == ReadInputRegisters,
+		control == ReadWriteMultipleRegisters:
+		if len(bytes) < 3 {
+			return 0
+		}
+		return 5 + int(bytes[2])
+	case control == WriteCoils, control == WriteRegisters,
+		control == WriteMultipleCoils, control == WriteMultipleRegisters:
+		return 8
+	case control == MaskWriteRegisters:
+		return 10
+	default:
+		//未知功能码,按CRC校验判断是否完整
+		if _, err := DecodeRTU(bytes); err == nil {
+			return len(bytes)
+		}
+		return 0
+	}
+}
+
+// tcpTransport TCP按事务号匹配响应,可以同时进行多个事务
+type tcpTransport struct {
+	conn      io.ReadWriteCloser
+	mu        sync.Mutex
+	order     uint16                 //事务号
+	pending   map[uint16]chan []byte //等待响应的事务
+	sem       chan struct{}          //限制同时进行的事务数量
+	writeMu   sync.Mutex
+	writeBuf  []byte //发送缓存,writeMu保护
+	readErr   error  //读取错误,closed关闭后有效
+	closing   bool   //主动关闭
+	gauge     connGauge
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newTCPTransport(conn io.ReadWriteCloser, concurrency int) *tcpTransport {
+	t := &tcpTransport{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		closed:  make(chan struct{}),
+	}
+	t.setConcurrency(concurrency)
+	go t.runRead()
+	return t
+}
+
+// setConcurrency 设置同时进行的事务数量,进行中的事务不受影响
+func (this *tcpTransport) setConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.sem = make(chan struct{}, n)
+}
+
+func (this *tcpTransport) send(ctx context.Context, req []byte) ([]byte, uint16, error) {
+	if len(req) < 8 {
+		return nil, 0, errors.New("请求数据长度异常(小于8)")
+	}
+	this.mu.Lock()
+	sem := this.sem
+	this.mu.Unlock()
+	//达到最大事务数量时阻塞,直到有事务完成或者请求取消
+	select {
+	case sem <- struct{}{}:
+		defer func() { <-sem }()
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case <-this.closed:
+		return nil, 0, this.err()
+	}
+
+	result := make(chan []byte, 1)
+	this.mu.Lock()
+	this.order++
+	for _, ok := this.pending[this.order]; ok; _, ok = this.pending[this.order] {
+		this.order++
+	}
+	order := this.order
+	this.pending[order] = result
+	this.mu.Unlock()
+	defer func() {
+		this.mu.Lock()
+		delete(this.pending, order)
+		this.mu.Unlock()
+	}()
+
+	//复制到发送缓存后写入事务号,不修改调用者的数据
+	this.writeMu.Lock()
+	this.writeBuf = append(this.writeBuf[:0], req...)
+	binary.BigEndian.PutUint16(this.writeBuf, order)
+	_, err := this.conn.Write(this.writeBuf)
+	this.writeMu.Unlock()
+	if err != nil {
+		return nil, order, err
+	}
+	//Modbus TCP不支持广播,单元标识0常用于直接寻址的设备,同样等待响应
+	select {
+	case bytes := <-result:
+		return bytes, order, nil
+	case <-ctx.Done():
+		return nil, order, ctx.Err()
+	case <-this.closed:
+		return nil, order, this.err()
+	}
+}
+
+func (this *tcpTransport) err() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closing || this.readErr == nil {
+		return ErrClosed
+	}
+	return this.readErr
+}
+
+func (this *tcpTransport) watch(m Metrics) { this.gauge.watch(m, this.closed) }
+
+func (this *tcpTransport) Close() error {
+	err := ErrClosed
+	this.closeOnce.Do(func() {
+		this.mu.Lock()
+		this.closing = true
+		this.mu.Unlock()
+		err = this.conn.Close()
+	})
+	return err
+}
+
+// runRead 读取响应,按事务号分发,未知事务号的响应直接丢弃
+func (this *tcpTransport) runRead() {
+	defer close(this.closed)
+	for {
+		bytes, err := readTCP(this.conn)
+		if err != nil {
+			this.mu.Lock()
+			this.readErr = err
+			this.mu.Unlock()
+			return
+		}
+		order := uint16(bytes[0])<<8 | uint16(bytes[1])
+		this.mu.Lock()
+		result, ok := this.pending[order]
+		delete(this.pending, order)
+		this.mu.Unlock()
+		if ok {
+			result <- bytes
+		}
+	}
+}
+
+// readTCP 按MBAP报文头的长度读取一帧完整的TCP数据
+func readTCP(r io.Reader) ([]byte, error) {
+	header := make([]byte, 6, 260)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[4])<<8 | int(header[5])
+	if length < 2 || length > 254 {
+		return nil, errors.New("数据长度错误:" + strconv.Itoa(length))
+	}
+	bytes := header[:6+length]
+	if _, err := io.ReadFull(r, bytes[6:]); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
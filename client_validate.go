@@ -0,0 +1,91 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMismatchSlave 响应的从站地址和请求不一致
+	ErrMismatchSlave = errors.New("从站地址不一致")
+
+	// ErrMismatchOrder 响应的事务号或协议和请求不一致(TCP)
+	ErrMismatchOrder = errors.New("事务号不一致")
+
+	// ErrMismatchControl 响应的功能码和请求不一致,且不是异常响应
+	ErrMismatchControl = errors.New("功能码不一致")
+
+	// ErrMismatchLength 响应的字节数和请求的数量不一致
+	ErrMismatchLength = errors.New("数据长度不一致")
+
+	// ErrMismatchEcho 写请求的响应(回显)和请求的地址,值或数量不一致
+	ErrMismatchEcho = errors.New("回显数据不一致")
+)
+
+// ResponseError 响应和请求不匹配,可以用errors.Is判断具体原因
+type ResponseError struct {
+	Err      error //原因 ErrMismatchSlave ErrMismatchOrder ErrMismatchControl ErrMismatchLength ErrMismatchEcho
+	Request  Frame //请求
+	Response Frame //响应
+}
+
+func (this *ResponseError) Error() string {
+	return fmt.Sprintf("响应和请求不匹配(%v),请求:%s,响应:%s", this.Err, this.Request.HEX(), this.Response.HEX())
+}
+
+func (this *ResponseError) Unwrap() error {
+	return this.Err
+}
+
+// Validate 校验响应和请求是否匹配,异常响应返回对应的异常码(例IllegalAddress)
+// 读请求校验字节数是否和请求的数量一致,写请求校验回显的地址,值和数量
+func Validate(request, response Frame) error {
+	mismatch := func(err error) error {
+		return &ResponseError{Err: err, Request: request, Response: response}
+	}
+	if request.GetSlave() != response.GetSlave() {
+		return mismatch(ErrMismatchSlave)
+	}
+	if req, ok := request.(*TCPFrame); ok {
+		resp, ok := response.(*TCPFrame)
+		if !ok || req.Order != resp.Order || req.Protocol != resp.Protocol {
+			return mismatch(ErrMismatchOrder)
+		}
+	}
+
+	control, data := response.GetControl(), response.GetData()
+	switch control {
+	case request.GetControl():
+	case request.GetControl() | 0x80:
+		return exception(control, data)
+	default:
+		return mismatch(ErrMismatchControl)
+	}
+
+	reqData := request.GetData()
+	switch control {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters, ReadWriteMultipleRegisters:
+		if len(reqData) < 4 || len(data) < 1 || int(data[0]) != len(data)-1 {
+			return mismatch(ErrMismatchLength)
+		}
+		quantity := int(reqData[2])<<8 | int(reqData[3])
+		length := quantity * 2
+		if control == ReadCoils || control == ReadDiscreteInputs {
+			length = (quantity + 7) / 8
+		}
+		if int(data[0]) != length {
+			return mismatch(ErrMismatchLength)
+		}
+	case WriteCoils, WriteRegisters, WriteMultipleCoils, WriteMultipleRegisters:
+		//单个写回显地址和值,多个写回显地址和数量
+		if len(data) != 4 || len(reqData) < 4 || !bytes.Equal(data, reqData[:4]) {
+			return mismatch(ErrMismatchEcho)
+		}
+	case MaskWriteRegisters:
+		if len(data) != 6 || !bytes.Equal(data, reqData) {
+			return mismatch(ErrMismatchEcho)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+// modbus-cli Modbus主站命令行工具,支持TCP,RTU over TCP和串口
+//
+//	modbus-cli -tcp 127.0.0.1:502 read 4x40001 10
+//	modbus-cli -tcp 127.0.0.1:502 -type float32 -order CDAB read 4x40001 2
+//	modbus-cli -rtu-tcp 127.0.0.1:502 write 4x40001 1 2 3
+//	modbus-cli -serial /dev/ttyUSB0 -baud 9600 -unit 2 write 0x00001 on
+//	modbus-cli -tcp 127.0.0.1:502 -interval 1s -format csv poll 3x30001 4
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goburrow/serial"
+	"github.com/injoyai/modbus"
+)
+
+type options struct {
+	tcp      string
+	rtuTCP   string
+	serial   string
+	baud     int
+	dataBits int
+	parity   string
+	stopBits int
+	unit     int
+	timeout  time.Duration
+	dataType string
+	order    string
+	format   string
+	interval time.Duration
+	times    int
+}
+
+func main() {
+	opt := &options{}
+	flag.StringVar(&opt.tcp, "tcp", "", "Modbus TCP地址,例 127.0.0.1:502")
+	flag.StringVar(&opt.rtuTCP, "rtu-tcp", "", "RTU over TCP地址,例 127.0.0.1:502")
+	flag.StringVar(&opt.serial, "serial", "", "串口,例 /dev/ttyUSB0 COM1")
+	flag.IntVar(&opt.baud, "baud", 9600, "串口波特率")
+	flag.IntVar(&opt.dataBits, "databits", 8, "串口数据位")
+	flag.StringVar(&opt.parity, "parity", "N", "串口校验 N E O")
+	flag.IntVar(&opt.stopBits, "stopbits", 1, "串口停止位")
+	flag.IntVar(&opt.unit, "unit", 1, "从站地址")
+	flag.DurationVar(&opt.timeout, "timeout", time.Second, "响应超时时间")
+	flag.StringVar(&opt.dataType, "type", "uint16", "寄存器数据类型 int16 uint16 int32 uint32 float32 int64 uint64 float64")
+	flag.StringVar(&opt.order, "order", "ABCD", "字节顺序 ABCD CDAB BADC DCBA")
+	flag.StringVar(&opt.format, "format", "table", "输出格式 table csv json")
+	flag.DurationVar(&opt.interval, "interval", time.Second, "轮询间隔")
+	flag.IntVar(&opt.times, "n", 0, "轮询次数,0表示一直轮询")
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := run(opt, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, describe(err))
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `用法: modbus-cli [参数] <命令>
+
+命令:
+  read  <地址> [数量]     读取线圈或寄存器,数量为值的数量
+  write <地址> <值>...    写入线圈(1/0/on/off)或保持寄存器
+  poll  <地址> [数量]     轮询读取,标记变化的值
+
+地址: 4x40001 4x400001 4x1 40001 hr:0 ir:0 co:0 di:0
+
+参数:
+`)
+	flag.PrintDefaults()
+}
+
+func run(opt *options, args []string) error {
+	if len(args) < 2 {
+		usage()
+		return errors.New("缺少命令或地址")
+	}
+	key, address, err := modbus.ParseAddress(args[1])
+	if err != nil {
+		return err
+	}
+	dataType := modbus.DataType(strings.ToLower(opt.dataType))
+	if key == modbus.KeyOutputCoils || key == modbus.KeyInputCoils {
+		dataType = modbus.TypeBool
+	} else if !dataType.Numeric() {
+		return errors.New("不支持的数据类型:" + opt.dataType)
+	}
+	order := modbus.Order(strings.ToUpper(opt.order))
+	switch order {
+	case modbus.OrderABCD, modbus.OrderCDAB, modbus.OrderBADC, modbus.OrderDCBA:
+	default:
+		return errors.New("不支持的字节顺序:" + opt.order)
+	}
+	out, err := newOutput(opt.format, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	c, err := dial(opt)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetTimeout(opt.timeout)
+	r := &reader{client: c, key: key, address: address, dataType: dataType, order: order}
+
+	switch args[0] {
+	case "read", "poll":
+		r.count = 1
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 1 {
+				return errors.New("数量错误:" + args[2])
+			}
+			r.count = n
+		}
+		if args[0] == "read" {
+			rows, err := r.read(context.Background())
+			if err != nil {
+				return err
+			}
+			return out.write(rows, false)
+		}
+		return poll(opt, r, out)
+	case "write":
+		if len(args) < 3 {
+			return errors.New("缺少写入的值")
+		}
+		result, err := write(c, key, address, dataType, order, args[2:])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("写入成功 %s 数量%d\n", modbus.FormatAddress(key, result.Address), result.Quantity)
+		return nil
+	}
+	usage()
+	return errors.New("未知命令:" + args[0])
+}
+
+// dial 根据参数建立连接
+func dial(opt *options) (*modbus.Client, error) {
+	unit := byte(opt.unit)
+	switch {
+	case opt.tcp != "":
+		return modbus.DialTCP(opt.tcp, unit)
+	case opt.rtuTCP != "":
+		return modbus.DialRTUOverTCP(opt.rtuTCP, unit)
+	case opt.serial != "":
+		return modbus.DialRTU(&serial.Config{
+			Address:  opt.serial,
+			BaudRate: opt.baud,
+			DataBits: opt.dataBits,
+			StopBits: opt.stopBits,
+			Parity:   strings.ToUpper(opt.parity),
+			Timeout:  opt.timeout,
+		}, unit)
+	}
+	return nil, errors.New("需要设置 -tcp, -rtu-tcp 或 -serial")
+}
+
+// poll 按间隔读取,和上次读取的值比较
+func poll(opt *options, r *reader, out output) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var last map[uint16]row
+	ticker := time.NewTicker(opt.interval)
+	defer ticker.Stop()
+	for i := 0; opt.times <= 0 || i < opt.times; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+		rows, err := r.read(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintln(os.Stderr, time.Now().Format("15:04:05.000"), describe(err))
+			continue
+		}
+		current := make(map[uint16]row, len(rows))
+		for j := range rows {
+			if old, ok := last[rows[j].offset]; ok && old.Raw != rows[j].Raw {
+				rows[j].Old, rows[j].Changed = old.Value, true
+			} else if !ok {
+				rows[j].Changed = true
+			}
+			current[rows[j].offset] = rows[j]
+		}
+		last = current
+		if err := out.write(rows, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe 错误转成可读的信息,异常码显示名称和说明
+func describe(err error) string {
+	var code modbus.Control
+	switch {
+	case errors.As(err, &code):
+		return fmt.Sprintf("从站异常响应 %s(0x%02X): %s", modbus.ExceptionName(byte(code)), byte(code)&0x7F, code.Error())
+	case modbus.IsTimeout(err):
+		return "响应超时: " + err.Error()
+	case errors.Is(err, modbus.ErrCRC):
+		return "CRC校验错误,检查波特率和校验位: " + err.Error()
+	}
+	return err.Error()
+}
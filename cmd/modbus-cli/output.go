@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// output 输出读取结果,poll为true时显示变化
+type output interface {
+	write(rows []row, poll bool) error
+}
+
+func newOutput(format string, w io.Writer) (output, error) {
+	switch format {
+	case "table":
+		return &tableOutput{w: w}, nil
+	case "csv":
+		return &csvOutput{w: csv.NewWriter(w)}, nil
+	case "json":
+		return &jsonOutput{e: json.NewEncoder(w)}, nil
+	}
+	return nil, errors.New("不支持的输出格式:" + format)
+}
+
+type tableOutput struct {
+	w io.Writer
+}
+
+func (this *tableOutput) write(rows []row, poll bool) error {
+	tw := tabwriter.NewWriter(this.w, 0, 4, 2, ' ', 0)
+	if poll && len(rows) > 0 {
+		fmt.Fprintf(tw, "--- %s\n", rows[0].Time.Format("15:04:05.000"))
+		fmt.Fprintln(tw, "\tADDRESS\tVALUE\tRAW\tOLD")
+	} else {
+		fmt.Fprintln(tw, "ADDRESS\tVALUE\tRAW")
+	}
+	for _, r := range rows {
+		if !poll {
+			fmt.Fprintf(tw, "%s\t%v\t%s\n", r.Address, r.Value, r.Raw)
+			continue
+		}
+		mark, old := " ", ""
+		if r.Changed {
+			mark = "*"
+		}
+		if r.Old != nil {
+			old = fmt.Sprint(r.Old)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\n", mark, r.Address, r.Value, r.Raw, old)
+	}
+	return tw.Flush()
+}
+
+type csvOutput struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (this *csvOutput) write(rows []row, poll bool) error {
+	if !this.header {
+		this.header = true
+		header := []string{"address", "value", "raw"}
+		if poll {
+			header = []string{"time", "address", "value", "raw", "old", "changed"}
+		}
+		this.w.Write(header)
+	}
+	for _, r := range rows {
+		record := []string{r.Address, fmt.Sprint(r.Value), r.Raw}
+		if poll {
+			old := ""
+			if r.Old != nil {
+				old = fmt.Sprint(r.Old)
+			}
+			record = append([]string{r.Time.Format("2006-01-02T15:04:05.000Z07:00")}, append(record, old, fmt.Sprint(r.Changed))...)
+		}
+		this.w.Write(record)
+	}
+	this.w.Flush()
+	return this.w.Error()
+}
+
+type jsonOutput struct {
+	e *json.Encoder
+}
+
+// write 读取时输出一个数组,轮询时每次输出一行
+func (this *jsonOutput) write(rows []row, poll bool) error {
+	return this.e.Encode(rows)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/injoyai/modbus"
+)
+
+// row 输出的一行
+type row struct {
+	Time    time.Time   `json:"time"`
+	Address string      `json:"address"`
+	Value   interface{} `json:"value"`
+	Raw     string      `json:"raw"`
+	Old     interface{} `json:"old,omitempty"`
+	Changed bool        `json:"changed,omitempty"`
+	offset  uint16
+}
+
+// reader 按数据类型读取
+type reader struct {
+	client   *modbus.Client
+	key      string
+	address  uint16
+	count    int
+	dataType modbus.DataType
+	order    modbus.Order
+}
+
+func (this *reader) read(ctx context.Context) ([]row, error) {
+	now := time.Now()
+	if this.dataType == modbus.TypeBool {
+		var values []bool
+		var err error
+		if this.key == modbus.KeyOutputCoils {
+			values, err = this.client.ReadOutputCoilsContext(ctx, this.address, uint16(this.count))
+		} else {
+			values, err = this.client.ReadInputCoilsContext(ctx, this.address, uint16(this.count))
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows := make([]row, len(values))
+		for i, v := range values {
+			offset := this.address + uint16(i)
+			rows[i] = row{Time: now, Address: modbus.FormatAddress(this.key, offset), Value: v, Raw: bit(v), offset: offset}
+		}
+		return rows, nil
+	}
+
+	n := this.dataType.Registers()
+	quantity := this.count * n
+	if quantity > 125 {
+		return nil, fmt.Errorf("寄存器数量%d超过125", quantity)
+	}
+	var registers []uint16
+	var err error
+	if this.key == modbus.KeyHoldingRegisters {
+		registers, err = this.client.ReadHoldingRegistersContext(ctx, this.address, uint16(quantity))
+	} else {
+		registers, err = this.client.ReadInputRegistersContext(ctx, this.address, uint16(quantity))
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]row, this.count)
+	for i := range rows {
+		words := registers[i*n : (i+1)*n]
+		value, err := modbus.DecodeValue(words, this.dataType, this.order)
+		if err != nil {
+			return nil, err
+		}
+		raw := make([]string, len(words))
+		for j, w := range words {
+			raw[j] = fmt.Sprintf("%04X", w)
+		}
+		offset := this.address + uint16(i*n)
+		rows[i] = row{Time: now, Address: modbus.FormatAddress(this.key, offset), Value: value, Raw: strings.Join(raw, " "), offset: offset}
+	}
+	return rows, nil
+}
+
+// write 写入线圈或保持寄存器
+func write(c *modbus.Client, key string, address uint16, t modbus.DataType, order modbus.Order, args []string) (*modbus.WriteResult, error) {
+	switch key {
+	case modbus.KeyOutputCoils:
+		values := make([]bool, len(args))
+		for i, s := range args {
+			switch strings.ToLower(s) {
+			case "1", "on", "true":
+				values[i] = true
+			case "0", "off", "false":
+			default:
+				return nil, errors.New("线圈的值错误:" + s)
+			}
+		}
+		if len(values) == 1 {
+			return c.WriteCoils(address, values[0])
+		}
+		return c.WriteMultipleCoils(address, uint16(len(values)), values)
+	case modbus.KeyHoldingRegisters:
+		registers := []uint16(nil)
+		for _, s := range args {
+			v, err := parse(s, t)
+			if err != nil {
+				return nil, err
+			}
+			words, err := modbus.EncodeValue(v, t, order, 0)
+			if err != nil {
+				return nil, err
+			}
+			registers = append(registers, words...)
+		}
+		if len(registers) == 1 {
+			return c.WriteRegisters(address, registers[0])
+		}
+		return c.WriteMultipleRegisters(address, uint16(len(registers)), modbus.RegistersToBytes(registers))
+	}
+	return nil, errors.New("只读的地址不能写入:" + modbus.FormatAddress(key, address))
+}
+
+// parse 按数据类型解析写入的值,整数不经过浮点数,超出范围时返回错误
+func parse(s string, t modbus.DataType) (interface{}, error) {
+	bits := t.Registers() * 16
+	switch t {
+	case modbus.TypeFloat32, modbus.TypeFloat64:
+		f, err := strconv.ParseFloat(s, bits)
+		if err != nil {
+			return nil, errors.New("数值错误:" + s)
+		}
+		return f, nil
+	case modbus.TypeInt16, modbus.TypeInt32, modbus.TypeInt64:
+		i, err := strconv.ParseInt(s, 0, bits)
+		if err != nil {
+			return nil, fmt.Errorf("数值错误或超出%s的范围:%s", t, s)
+		}
+		return i, nil
+	case modbus.TypeUint16, modbus.TypeUint32, modbus.TypeUint64:
+		u, err := strconv.ParseUint(s, 0, bits)
+		if err != nil {
+			return nil, fmt.Errorf("数值错误或超出%s的范围:%s", t, s)
+		}
+		return u, nil
+	}
+	return nil, errors.New("不支持写入的数据类型:" + string(t))
+}
+
+func bit(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
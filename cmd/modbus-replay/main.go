@@ -0,0 +1,73 @@
+// modbus-replay 重放抓包文件(pcap或JSONL)中的请求,和抓包中的响应比较
+//
+//	modbus-replay -file capture.jsonl                    在内存从站中重放
+//	modbus-replay -file capture.pcap -addr 127.0.0.1:502 发送给TCP设备
+//	modbus-replay -file capture.pcap -addr 127.0.0.1:502 -rtu 通过RTU over TCP发送
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/injoyai/modbus"
+)
+
+func main() {
+	file := flag.String("file", "", "抓包文件,pcap或JSONL")
+	addr := flag.String("addr", "", "设备地址,为空时在内存从站中重放")
+	rtu := flag.Bool("rtu", false, "按RTU over TCP发送")
+	timeout := flag.Duration("timeout", time.Second, "响应超时时间")
+	flag.Parse()
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fail(err)
+	}
+	records, err := modbus.ReadCapture(f)
+	f.Close()
+	if err != nil {
+		fail(err)
+	}
+
+	var results []*modbus.ReplayResult
+	if *addr == "" {
+		s := modbus.NewServer().SetMemory(modbus.NewMemory())
+		results = modbus.ReplayServer(s, records)
+	} else {
+		dial := modbus.DialTCP
+		if *rtu {
+			dial = modbus.DialRTUOverTCP
+		}
+		c, err := dial(*addr, 1)
+		if err != nil {
+			fail(err)
+		}
+		defer c.Close()
+		c.SetTimeout(*timeout)
+		results = modbus.ReplayClient(context.Background(), c, records)
+	}
+
+	diff := 0
+	for _, r := range results {
+		if !r.Match() {
+			diff++
+		}
+		fmt.Println(r)
+	}
+	fmt.Printf("共%d个请求,%d个不一致\n", len(results), diff)
+	if diff > 0 {
+		os.Exit(1)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/injoyai/modbus"
+)
+
+// serveAdmin 管理接口
+//
+//	GET  /units                                        所有从站地址
+//	GET  /units/1/holding_registers?address=0&count=10 读取值
+//	POST /units/1/holding_registers {"address":0,"values":[1,2]} 写入值,线圈为true/false
+//	GET  /metrics                                      Prometheus格式的指标
+func (this *sim) serveAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", this.metrics)
+	mux.HandleFunc("/units", func(w http.ResponseWriter, r *http.Request) {
+		this.mu.RLock()
+		ids := make([]int, 0, len(this.units))
+		for id := range this.units {
+			ids = append(ids, int(id))
+		}
+		this.mu.RUnlock()
+		sort.Ints(ids)
+		writeJSON(w, http.StatusOK, ids)
+	})
+	mux.HandleFunc("/units/", this.handleUnit)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (this *sim) handleUnit(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/units/"), "/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "路径格式 /units/{id}/{table}")
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	u := (*unit)(nil)
+	if err == nil && id >= 0 && id <= 255 {
+		u = this.unit(byte(id))
+	}
+	if u == nil {
+		writeError(w, http.StatusNotFound, "从站不存在:"+parts[0])
+		return
+	}
+	key := tableKey(parts[1])
+	if key == "" {
+		writeError(w, http.StatusNotFound, "寄存器表不存在:"+parts[1])
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		address, err1 := strconv.ParseUint(r.URL.Query().Get("address"), 10, 16)
+		count, err2 := strconv.ParseUint(orString(r.URL.Query().Get("count"), "1"), 10, 16)
+		if err1 != nil || err2 != nil || count == 0 || address+count > 65536 {
+			writeError(w, http.StatusBadRequest, "address或count错误")
+			return
+		}
+		a, n := uint16(address), uint16(count)
+		switch key {
+		case modbus.KeyOutputCoils:
+			writeJSON(w, http.StatusOK, u.memory.GetCoils(a, n))
+		case modbus.KeyInputCoils:
+			writeJSON(w, http.StatusOK, u.memory.GetDiscreteInputs(a, n))
+		case modbus.KeyInputRegisters:
+			writeJSON(w, http.StatusOK, u.memory.GetInputRegisters(a, n))
+		default:
+			writeJSON(w, http.StatusOK, u.memory.GetHoldingRegisters(a, n))
+		}
+	case http.MethodPost, http.MethodPut:
+		var body struct {
+			Address uint16            `json:"address"`
+			Values  []json.RawMessage `json:"values"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Values) == 0 {
+			writeError(w, http.StatusBadRequest, "格式 {\"address\":0,\"values\":[...]}")
+			return
+		}
+		if key == modbus.KeyOutputCoils || key == modbus.KeyInputCoils {
+			values := make([]bool, len(body.Values))
+			for i, v := range body.Values {
+				if err := json.Unmarshal(v, &values[i]); err != nil {
+					writeError(w, http.StatusBadRequest, "线圈的值需要true/false")
+					return
+				}
+			}
+			if key == modbus.KeyOutputCoils {
+				u.memory.SetCoils(body.Address, values...)
+			} else {
+				u.memory.SetDiscreteInputs(body.Address, values...)
+			}
+		} else {
+			values := make([]uint16, len(body.Values))
+			for i, v := range body.Values {
+				if err := json.Unmarshal(v, &values[i]); err != nil {
+					writeError(w, http.StatusBadRequest, "寄存器的值需要0-65535")
+					return
+				}
+			}
+			if key == modbus.KeyInputRegisters {
+				u.memory.SetInputRegisters(body.Address, values...)
+			} else {
+				u.memory.SetHoldingRegisters(body.Address, values...)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "只支持GET和POST")
+	}
+}
+
+func orString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/injoyai/modbus"
+)
+
+// Config 模拟器配置,使用JSON格式
+type Config struct {
+	TCP    string        `json:"tcp"`    //TCP监听地址,例 ":502"
+	Serial *SerialConfig `json:"serial"` //串口,为空时不监听
+	Admin  string        `json:"admin"`  //管理接口的HTTP地址,为空时不启用
+	Units  []*UnitConfig `json:"units"`  //从站
+}
+
+// SerialConfig 串口配置
+type SerialConfig struct {
+	Address  string `json:"address"`
+	BaudRate int    `json:"baud"`
+	DataBits int    `json:"data_bits"`
+	StopBits int    `json:"stop_bits"`
+	Parity   string `json:"parity"`
+}
+
+// UnitConfig 一个从站的寄存器表和生成器
+type UnitConfig struct {
+	ID               byte               `json:"id"`
+	Coils            []*CoilBlock       `json:"coils"`
+	DiscreteInputs   []*CoilBlock       `json:"discrete_inputs"`
+	InputRegisters   []*RegisterBlock   `json:"input_registers"`
+	HoldingRegisters []*RegisterBlock   `json:"holding_registers"`
+	Generators       []*GeneratorConfig `json:"generators"`
+}
+
+// CoilBlock 连续的线圈初始值
+type CoilBlock struct {
+	Address uint16 `json:"address"`
+	Values  []bool `json:"values"`
+}
+
+// RegisterBlock 连续的寄存器初始值,按类型编码,默认uint16
+type RegisterBlock struct {
+	Address uint16    `json:"address"`
+	Type    string    `json:"type"`
+	Order   string    `json:"order"`
+	Values  []float64 `json:"values"`
+}
+
+// GeneratorConfig 值生成器
+type GeneratorConfig struct {
+	Table     string   `json:"table"`     //input_registers(ir) 或 holding_registers(hr)
+	Address   uint16   `json:"address"`   //地址
+	Type      string   `json:"type"`      //数据类型,默认uint16
+	Order     string   `json:"order"`     //字节顺序,默认ABCD
+	Kind      string   `json:"kind"`      //ramp sine random counter
+	Min       float64  `json:"min"`       //ramp和random的最小值
+	Max       float64  `json:"max"`       //ramp和random的最大值
+	Step      float64  `json:"step"`      //ramp和counter的步长,默认1
+	Amplitude float64  `json:"amplitude"` //sine的振幅
+	Offset    float64  `json:"offset"`    //sine的偏移
+	Period    Duration `json:"period"`    //sine的周期,默认1分钟
+	Interval  Duration `json:"interval"`  //更新间隔,默认1秒
+}
+
+// Duration 支持 "1s" 格式的时间
+type Duration time.Duration
+
+func (this *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return errors.New("时间格式错误,例 \"1s\":" + string(bs))
+	}
+	d, err := time.ParseDuration(s)
+	*this = Duration(d)
+	return err
+}
+
+// LoadConfig 读取并校验配置文件
+func LoadConfig(filename string) (*Config, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(bs, cfg); err != nil {
+		return nil, fmt.Errorf("配置文件格式错误:%v", err)
+	}
+	if cfg.TCP == "" && cfg.Serial == nil {
+		return nil, errors.New("需要配置tcp或serial")
+	}
+	ids := map[byte]bool{}
+	for _, u := range cfg.Units {
+		//0是广播地址,从站不能使用
+		if u.ID == 0 || u.ID > 247 || ids[u.ID] {
+			return nil, fmt.Errorf("从站地址错误或重复:%d", u.ID)
+		}
+		ids[u.ID] = true
+		for _, b := range append(append([]*RegisterBlock(nil), u.InputRegisters...), u.HoldingRegisters...) {
+			if _, _, err := valueType(b.Type, b.Order); err != nil {
+				return nil, fmt.Errorf("从站%d地址%d:%v", u.ID, b.Address, err)
+			}
+		}
+		for _, g := range u.Generators {
+			if err := g.check(); err != nil {
+				return nil, fmt.Errorf("从站%d生成器(地址%d):%v", u.ID, g.Address, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// valueType 解析数据类型和字节顺序,默认uint16和ABCD
+func valueType(t, order string) (modbus.DataType, modbus.Order, error) {
+	dataType, o := modbus.TypeUint16, modbus.OrderABCD
+	if t != "" {
+		dataType = modbus.DataType(strings.ToLower(t))
+	}
+	if order != "" {
+		o = modbus.Order(strings.ToUpper(order))
+	}
+	if !dataType.Numeric() {
+		return "", "", errors.New("不支持的数据类型:" + t)
+	}
+	switch o {
+	case modbus.OrderABCD, modbus.OrderCDAB, modbus.OrderBADC, modbus.OrderDCBA:
+	default:
+		return "", "", errors.New("不支持的字节顺序:" + order)
+	}
+	return dataType, o, nil
+}
+
+// tableKey 寄存器表名称转成类型
+func tableKey(table string) string {
+	switch strings.ToLower(table) {
+	case "coils", "co":
+		return modbus.KeyOutputCoils
+	case "discrete_inputs", "di":
+		return modbus.KeyInputCoils
+	case "input_registers", "ir":
+		return modbus.KeyInputRegisters
+	case "holding_registers", "hr":
+		return modbus.KeyHoldingRegisters
+	}
+	return ""
+}
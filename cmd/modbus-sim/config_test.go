@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig 把配置写入临时文件,返回文件名
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "modbus-sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "device.json")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig("example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Units) != 2 || cfg.Units[0].ID != 1 || len(cfg.Units[0].Generators) != 4 {
+		t.Errorf("%+v", cfg)
+	}
+
+	for _, c := range []struct {
+		content string
+		err     string
+	}{
+		{`{"units":[]}`, "tcp或serial"},
+		{`{"tcp":":502","units":[{"id":0}]}`, "从站地址"},
+		{`{"tcp":":502","units":[{"id":248}]}`, "从站地址"},
+		{`{"tcp":":502","units":[{"id":1},{"id":1}]}`, "从站地址"},
+		{`{"tcp":":502","units":[{"id":1,"holding_registers":[{"type":"string"}]}]}`, "数据类型"},
+		{`{"tcp":":502","units":[{"id":1,"generators":[{"table":"co","kind":"ramp"}]}]}`, "生成器"},
+		{`{"tcp":":502","units":[{"id":1,"generators":[{"table":"hr","interval":1}]}]}`, "格式错误"},
+	} {
+		if _, err := LoadConfig(writeConfig(t, c.content)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s 期望错误%q,实际%v", c.content, c.err, err)
+		}
+	}
+}
+
+func TestGeneratorCheck(t *testing.T) {
+	for _, c := range []struct {
+		g  GeneratorConfig
+		ok bool
+	}{
+		{GeneratorConfig{Table: "hr", Kind: "ramp", Max: 10}, true},
+		{GeneratorConfig{Table: "input_registers", Type: "float32", Order: "cdab", Kind: "sine"}, true},
+		{GeneratorConfig{Table: "ir", Kind: "counter"}, true},
+		{GeneratorConfig{Table: "coils", Kind: "counter"}, false},
+		{GeneratorConfig{Table: "hr", Kind: "random", Min: 10, Max: 1}, false},
+		{GeneratorConfig{Table: "hr", Kind: "square"}, false},
+		{GeneratorConfig{Table: "hr", Type: "bool", Kind: "counter"}, false},
+		{GeneratorConfig{Table: "hr", Order: "ACBD", Kind: "counter"}, false},
+	} {
+		if err := c.g.check(); (err == nil) != c.ok {
+			t.Errorf("%+v 期望%v,实际%v", c.g, c.ok, err)
+		}
+	}
+}
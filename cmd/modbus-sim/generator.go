@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/injoyai/modbus"
+)
+
+func (this *GeneratorConfig) check() error {
+	key := tableKey(this.Table)
+	if key != modbus.KeyInputRegisters && key != modbus.KeyHoldingRegisters {
+		return errors.New("生成器只支持input_registers和holding_registers:" + this.Table)
+	}
+	if _, _, err := valueType(this.Type, this.Order); err != nil {
+		return err
+	}
+	switch this.Kind {
+	case "ramp", "random":
+		if this.Max < this.Min {
+			return errors.New("max小于min")
+		}
+	case "sine", "counter":
+	default:
+		return errors.New("未知生成器:" + this.Kind)
+	}
+	return nil
+}
+
+// run 按间隔生成值并写入存储,ctx结束时退出
+func (this *GeneratorConfig) run(ctx context.Context, m *modbus.Memory) {
+	dataType, order, _ := valueType(this.Type, this.Order)
+	interval := time.Duration(this.Interval)
+	if interval <= 0 {
+		interval = time.Second
+	}
+	period := time.Duration(this.Period)
+	if period <= 0 {
+		period = time.Minute
+	}
+	step := this.Step
+	if step == 0 {
+		step = 1
+	}
+	set := m.SetInputRegisters
+	if tableKey(this.Table) == modbus.KeyHoldingRegisters {
+		set = m.SetHoldingRegisters
+	}
+
+	start, value := time.Now(), this.Min
+	if this.Kind == "counter" {
+		value = 0
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if words, err := modbus.EncodeValue(value, dataType, order, 0); err == nil {
+			set(this.Address, words...)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			switch this.Kind {
+			case "ramp":
+				if value += step; value > this.Max {
+					value = this.Min
+				}
+			case "sine":
+				value = this.Offset + this.Amplitude*math.Sin(2*math.Pi*now.Sub(start).Seconds()/period.Seconds())
+			case "random":
+				value = this.Min + rand.Float64()*(this.Max-this.Min)
+			case "counter":
+				value += step
+			}
+			if value = wrap(value, dataType); this.Kind == "counter" && value < 0 {
+				value = 0
+			}
+		}
+	}
+}
+
+// wrap 计数器超过数据类型的范围时从0开始
+func wrap(value float64, t modbus.DataType) float64 {
+	max := math.Inf(1)
+	switch t {
+	case modbus.TypeUint16:
+		max = math.MaxUint16
+	case modbus.TypeInt16:
+		max = math.MaxInt16
+	case modbus.TypeUint32:
+		max = math.MaxUint32
+	case modbus.TypeInt32:
+		max = math.MaxInt32
+	}
+	if value > max {
+		return 0
+	}
+	return value
+}
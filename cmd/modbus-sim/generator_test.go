@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/injoyai/modbus"
+)
+
+func TestGeneratorRun(t *testing.T) {
+	m := modbus.NewMemory()
+	g := &GeneratorConfig{Table: "hr", Address: 3, Kind: "ramp", Min: 10, Max: 20, Step: 5, Interval: Duration(time.Millisecond * 5)}
+	if err := g.check(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		g.run(ctx, m)
+		close(done)
+	}()
+	//初始值为min,每次更新增加step,超过max后回到min
+	seen := map[uint16]bool{}
+	for deadline := time.Now().Add(time.Second); len(seen) < 3 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		v := m.GetHoldingRegisters(3, 1)[0]
+		if v == 0 {
+			//还未写入
+			continue
+		}
+		if v != 10 && v != 15 && v != 20 {
+			t.Fatal("生成的值超出范围:", v)
+		}
+		seen[v] = true
+	}
+	cancel()
+	<-done
+	if len(seen) != 3 {
+		t.Error("期望生成10,15,20,实际", seen)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if wrap(65536, modbus.TypeUint16) != 0 || wrap(65535, modbus.TypeUint16) != 65535 || wrap(1e10, modbus.TypeFloat32) != 1e10 {
+		t.Error("计数器超过范围时应从0开始")
+	}
+}
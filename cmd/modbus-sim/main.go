@@ -0,0 +1,211 @@
+// modbus-sim 根据JSON配置文件模拟Modbus从站,支持多个从站地址,值生成器,热加载和管理接口
+//
+//	modbus-sim -config device.json
+//	modbus-sim -config device.json -watch -v
+//
+// 配置示例见 example.json
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+	"github.com/injoyai/modbus"
+)
+
+func main() {
+	filename := flag.String("config", "device.json", "配置文件")
+	watch := flag.Bool("watch", false, "配置文件修改后重新加载寄存器表和生成器")
+	verbose := flag.Bool("v", false, "输出通讯日志")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := newSim()
+	s.load(cfg)
+
+	server := modbus.NewServer().SetMetrics(s.metrics)
+	if *verbose {
+		server.SetLogger(modbus.NewStdLogger(nil, modbus.LevelDebug))
+	}
+	for _, fc := range []int{1, 2, 3, 4, 5, 6, 15, 16} {
+		server.SetHandler(fc, s.dispatch(fc))
+	}
+	if cfg.Admin != "" {
+		go func() { log.Fatal(s.serveAdmin(cfg.Admin)) }()
+		log.Println("管理接口:", cfg.Admin)
+	}
+	if cfg.Serial != nil {
+		err := server.ListenRTU(&serial.Config{
+			Address:  cfg.Serial.Address,
+			BaudRate: orDefault(cfg.Serial.BaudRate, 9600),
+			DataBits: orDefault(cfg.Serial.DataBits, 8),
+			StopBits: orDefault(cfg.Serial.StopBits, 1),
+			Parity:   cfg.Serial.Parity,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("监听串口:", cfg.Serial.Address)
+	}
+	if *watch {
+		go s.watch(*filename)
+	}
+	if cfg.TCP == "" {
+		select {}
+	}
+	log.Println("监听TCP:", cfg.TCP)
+	log.Fatal(server.ListenAndServe(cfg.TCP))
+}
+
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// unit 一个模拟的从站
+type unit struct {
+	id     byte
+	memory *modbus.Memory
+	server *modbus.Server
+	config *UnitConfig //最后加载的配置
+}
+
+type sim struct {
+	mu      sync.RWMutex
+	units   map[byte]*unit
+	cancel  context.CancelFunc
+	metrics *modbus.PromMetrics
+}
+
+func newSim() *sim {
+	return &sim{units: map[byte]*unit{}, metrics: modbus.NewPromMetrics()}
+}
+
+// load 按配置更新从站并重新启动生成器
+// 已有的从站保留存储,只写入新增或修改的初始值,其他地址保留主站写入的值,删除的从站不再响应
+func (this *sim) load(cfg *Config) {
+	this.mu.RLock()
+	old := this.units
+	this.mu.RUnlock()
+	units := make(map[byte]*unit, len(cfg.Units))
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, c := range cfg.Units {
+		u := &unit{id: c.ID, memory: modbus.NewMemory(), config: &UnitConfig{}}
+		if o := old[c.ID]; o != nil {
+			u.memory, u.server, u.config = o.memory, o.server, o.config
+		}
+		if u.server == nil {
+			u.server = modbus.NewServer().SetMemory(u.memory)
+		}
+		m := u.memory
+		for _, b := range c.Coils {
+			if changed(b, u.config.Coils) {
+				m.SetCoils(b.Address, b.Values...)
+			}
+		}
+		for _, b := range c.DiscreteInputs {
+			if changed(b, u.config.DiscreteInputs) {
+				m.SetDiscreteInputs(b.Address, b.Values...)
+			}
+		}
+		for _, b := range c.InputRegisters {
+			if changed(b, u.config.InputRegisters) {
+				m.SetInputRegisters(b.Address, encode(b)...)
+			}
+		}
+		for _, b := range c.HoldingRegisters {
+			if changed(b, u.config.HoldingRegisters) {
+				m.SetHoldingRegisters(b.Address, encode(b)...)
+			}
+		}
+		for _, g := range c.Generators {
+			go g.run(ctx, m)
+		}
+		u.config = c
+		units[c.ID] = u
+	}
+
+	this.mu.Lock()
+	oldCancel := this.cancel
+	this.units, this.cancel = units, cancel
+	this.mu.Unlock()
+	if oldCancel != nil {
+		oldCancel()
+	}
+}
+
+// changed 配置块是否是新增的或者修改过的,list为上次加载的同类配置块
+func changed(b interface{}, list interface{}) bool {
+	v := reflect.ValueOf(list)
+	for i := 0; i < v.Len(); i++ {
+		if reflect.DeepEqual(b, v.Index(i).Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+func encode(b *RegisterBlock) []uint16 {
+	dataType, order, _ := valueType(b.Type, b.Order)
+	result := []uint16(nil)
+	for _, v := range b.Values {
+		words, err := modbus.EncodeValue(v, dataType, order, 0)
+		if err != nil {
+			log.Printf("地址%d的值%v错误:%v", b.Address, v, err)
+			continue
+		}
+		result = append(result, words...)
+	}
+	return result
+}
+
+func (this *sim) unit(id byte) *unit {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.units[id]
+}
+
+// dispatch 按从站地址交给对应的从站处理,未配置的从站响应网关目标设备无响应
+func (this *sim) dispatch(fc int) modbus.Handler {
+	return func(f modbus.Frame) ([]byte, modbus.Control) {
+		u := this.unit(f.GetSlave())
+		if u == nil {
+			return nil, modbus.GatewayResponseFail
+		}
+		return u.server.Handler[fc](f)
+	}
+}
+
+// watch 每秒检查配置文件的修改时间,修改后重新加载,监听地址的修改需要重启
+func (this *sim) watch(filename string) {
+	last := time.Time{}
+	if info, err := os.Stat(filename); err == nil {
+		last = info.ModTime()
+	}
+	for range time.Tick(time.Second) {
+		info, err := os.Stat(filename)
+		if err != nil || !info.ModTime().After(last) {
+			continue
+		}
+		last = info.ModTime()
+		cfg, err := LoadConfig(filename)
+		if err != nil {
+			log.Println("重新加载失败:", err)
+			continue
+		}
+		this.load(cfg)
+		log.Println("已重新加载配置:", filename, fmt.Sprintf("(%d个从站)", len(cfg.Units)))
+	}
+}
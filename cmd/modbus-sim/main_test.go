@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSimReload(t *testing.T) {
+	s := newSim()
+	s.load(&Config{Units: []*UnitConfig{
+		{ID: 1, HoldingRegisters: []*RegisterBlock{{Address: 0, Values: []float64{1, 2}}, {Address: 10, Values: []float64{3}}}},
+		{ID: 2},
+	}})
+	defer s.cancel()
+	m := s.unit(1).memory
+	//主站写入的值
+	m.WriteRegisters(0, []uint16{100, 200})
+	m.WriteRegisters(10, []uint16{300})
+
+	//修改地址10的初始值,删除从站2,新增从站3
+	s.load(&Config{Units: []*UnitConfig{
+		{ID: 1, HoldingRegisters: []*RegisterBlock{{Address: 0, Values: []float64{1, 2}}, {Address: 10, Values: []float64{4}}}},
+		{ID: 3, HoldingRegisters: []*RegisterBlock{{Address: 0, Values: []float64{5}}}},
+	}})
+	if s.unit(1).memory != m {
+		t.Fatal("重新加载后应保留从站的存储")
+	}
+	if v := m.GetHoldingRegisters(0, 2); v[0] != 100 || v[1] != 200 {
+		t.Error("未修改的配置不应覆盖写入的值", v)
+	}
+	if v := m.GetHoldingRegisters(10, 1); v[0] != 4 {
+		t.Error("修改的配置应写入新的初始值", v)
+	}
+	if s.unit(2) != nil {
+		t.Error("删除的从站不应再响应")
+	}
+	if u := s.unit(3); u == nil || u.memory.GetHoldingRegisters(0, 1)[0] != 5 {
+		t.Error("新增的从站应写入初始值")
+	}
+}
@@ -0,0 +1,634 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// AddressRange 地址范围,Quantity为0表示整个地址空间都可以访问
+type AddressRange struct {
+	Start    uint16
+	Quantity uint16
+}
+
+// available 从起始地址开始可以访问的数量
+func (this *AddressRange) available() int {
+	if this.Quantity == 0 {
+		return 65536 - int(this.Start)
+	}
+	return int(this.Quantity)
+}
+
+// last 地址空间末尾最多n个地址的起始地址,范围不包含地址0xFFFF时返回false
+func (this *AddressRange) last(n int) (uint16, bool) {
+	if int(this.Start)+this.available() < 65536 {
+		return 0, false
+	}
+	if available := this.available(); n > available {
+		n = available
+	}
+	return uint16(65536 - n), true
+}
+
+// outside 范围之外的第一个地址,整个地址空间都可以访问时返回false
+func (this *AddressRange) outside() (uint16, bool) {
+	end := int(this.Start) + int(this.Quantity)
+	if this.Quantity == 0 || end > 0xFFFF {
+		return 0, false
+	}
+	return uint16(end), true
+}
+
+// Conformance 从站一致性测试,按Modbus协议规范逐项检查被测从站的响应
+// 会写入配置的线圈和保持寄存器,检查后恢复原值
+type Conformance struct {
+	Transport        string        //传输方式 "TCP" or "RTU"
+	Slave            byte          //从站地址
+	Timeout          time.Duration //等待响应的时间,默认1秒,广播时等待该时间确认没有响应
+	Coils            *AddressRange //可读写的线圈,为nil时跳过
+	DiscreteInputs   *AddressRange //可读的离散输入,为nil时跳过
+	InputRegisters   *AddressRange //可读的输入寄存器,为nil时跳过
+	HoldingRegisters *AddressRange //可读写的保持寄存器,为nil时跳过
+	Broadcast        bool          //检查RTU广播,需要配置保持寄存器
+}
+
+// ConformanceResult 一项检查的结果
+type ConformanceResult struct {
+	Clause string //条款编号,例 "FC03.1"
+	Name   string //检查内容
+	Pass   bool   //是否通过
+	Skip   bool   //是否跳过
+	Err    error  //失败或跳过的原因
+}
+
+func (this *ConformanceResult) String() string {
+	switch {
+	case this.Skip:
+		return fmt.Sprintf("SKIP %s %s: %v", this.Clause, this.Name, this.Err)
+	case this.Pass:
+		return fmt.Sprintf("PASS %s %s", this.Clause, this.Name)
+	default:
+		return fmt.Sprintf("FAIL %s %s: %v", this.Clause, this.Name, this.Err)
+	}
+}
+
+// ConformanceReport 一致性测试报告
+type ConformanceReport struct {
+	Results []*ConformanceResult
+}
+
+// Passed 没有失败的检查
+func (this *ConformanceReport) Passed() bool {
+	return len(this.Failed()) == 0
+}
+
+// Failed 失败的检查
+func (this *ConformanceReport) Failed() (list []*ConformanceResult) {
+	for _, r := range this.Results {
+		if !r.Pass && !r.Skip {
+			list = append(list, r)
+		}
+	}
+	return
+}
+
+// String 每项检查一行,最后一行为统计
+func (this *ConformanceReport) String() string {
+	sb := strings.Builder{}
+	pass, skip := 0, 0
+	for _, r := range this.Results {
+		sb.WriteString(r.String())
+		sb.WriteString("\n")
+		if r.Pass {
+			pass++
+		}
+		if r.Skip {
+			skip++
+		}
+	}
+	sb.WriteString(fmt.Sprintf("通过%d,失败%d,跳过%d", pass, len(this.Results)-pass-skip, skip))
+	return sb.String()
+}
+
+// Run 通过conn执行一致性测试,conn由调用者关闭,关闭后后台读取结束
+func (this *Conformance) Run(ctx context.Context, conn io.ReadWriter) *ConformanceReport {
+	timeout := this.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	r := &conformanceRun{
+		Conformance: this,
+		ctx:         ctx,
+		conn:        conn,
+		timeout:     timeout,
+		read:        make(chan []byte, 16),
+		done:        make(chan struct{}),
+		report:      &ConformanceReport{},
+	}
+	defer close(r.done)
+	go r.runRead()
+	r.run()
+	return r.report
+}
+
+// conformanceRun 一次一致性测试
+type conformanceRun struct {
+	*Conformance
+	ctx     context.Context
+	conn    io.ReadWriter
+	timeout time.Duration
+	read    chan []byte
+	done    chan struct{} //测试结束后关闭,后台读取不再阻塞
+	readErr error
+	order   uint16
+	report  *ConformanceReport
+}
+
+func (this *conformanceRun) run() {
+	this.checkRead("FC01", "读线圈", ReadCoils, this.Coils, 2000)
+	this.checkRead("FC02", "读离散输入", ReadDiscreteInputs, this.DiscreteInputs, 2000)
+	this.checkRead("FC03", "读保持寄存器", ReadHoldingRegisters, this.HoldingRegisters, 125)
+	this.checkRead("FC04", "读输入寄存器", ReadInputRegisters, this.InputRegisters, 125)
+	this.checkWriteCoil()
+	this.checkWriteRegister()
+	this.checkWriteCoils()
+	this.checkWriteRegisters()
+	this.check("EX.1", "不支持的功能码响应非法功能", func() error {
+		return this.expectException(0x41, []byte{0, 0, 0, 1}, IllegalFunction)
+	})
+	this.checkBroadcast()
+}
+
+// checkRead 读功能码的检查
+func (this *conformanceRun) checkRead(clause, name string, control Control, r *AddressRange, limit int) {
+	if r == nil {
+		this.skip(clause, name, errors.New("未配置地址范围"))
+		return
+	}
+	this.check(clause+".1", name+" 正常响应", func() error {
+		quantity := r.available()
+		if quantity > 8 {
+			quantity = 8
+		}
+		_, err := this.expectNormal(control, addressData(r.Start, uint16(quantity)))
+		return err
+	})
+	if r.available() >= limit {
+		this.check(clause+".2", fmt.Sprintf("%s 最大数量%d", name, limit), func() error {
+			_, err := this.expectNormal(control, addressData(r.Start, uint16(limit)))
+			return err
+		})
+	} else {
+		this.skip(clause+".2", fmt.Sprintf("%s 最大数量%d", name, limit), errors.New("地址范围小于最大数量"))
+	}
+	this.check(clause+".3", name+" 数量为0响应非法数据值", func() error {
+		return this.expectException(control, addressData(r.Start, 0), IllegalData)
+	})
+	this.check(clause+".4", name+" 数量超过上限响应非法数据值", func() error {
+		return this.expectException(control, addressData(r.Start, uint16(limit+1)), IllegalData)
+	})
+	this.check(clause+".5", name+" 地址溢出响应非法数据地址", func() error {
+		return this.expectException(control, addressData(0xFFFF, 2), IllegalAddress)
+	})
+	this.checkOutside(clause+".6", name, control, r, []byte{0, 1})
+	this.checkLength(clause+".7", name, control, addressData(r.Start, 1)[:3])
+}
+
+// checkWriteCoil 写单个线圈的检查
+func (this *conformanceRun) checkWriteCoil() {
+	clause, name, r := "FC05", "写单个线圈", this.Coils
+	if r == nil {
+		this.skip(clause, name, errors.New("未配置地址范围"))
+		return
+	}
+	this.check(clause+".1", fmt.Sprintf("%s 地址%d", name, r.Start), func() error {
+		old, err := this.readCoils(r.Start, 1)
+		if err != nil {
+			return err
+		}
+		return this.verifyCoils(r.Start, []bool{!old[0]}, old, func(value []bool) error {
+			data := []byte{byte(r.Start >> 8), byte(r.Start), 0, 0}
+			if value[0] {
+				data[2] = 0xFF
+			}
+			_, err := this.expectNormal(WriteCoils, data)
+			return err
+		})
+	})
+	this.check(clause+".2", name+" 非法值响应非法数据值", func() error {
+		return this.expectException(WriteCoils, addressData(r.Start, 0x1234), IllegalData)
+	})
+	this.checkOutside(clause+".3", name, WriteCoils, r, []byte{0, 0})
+	this.checkLength(clause+".4", name, WriteCoils, addressData(r.Start, 0)[:3])
+}
+
+// checkWriteRegister 写单个寄存器的检查
+func (this *conformanceRun) checkWriteRegister() {
+	clause, name, r := "FC06", "写单个寄存器", this.HoldingRegisters
+	if r == nil {
+		this.skip(clause, name, errors.New("未配置地址范围"))
+		return
+	}
+	this.check(clause+".1", fmt.Sprintf("%s 地址%d", name, r.Start), func() error {
+		old, err := this.readRegisters(r.Start, 1)
+		if err != nil {
+			return err
+		}
+		return this.verifyRegisters(r.Start, []uint16{^old[0]}, old, func(value []uint16) error {
+			_, err := this.expectNormal(WriteRegisters, addressData(r.Start, value[0]))
+			return err
+		})
+	})
+	this.checkOutside(clause+".2", name, WriteRegisters, r, []byte{0, 0})
+	this.checkLength(clause+".3", name, WriteRegisters, addressData(r.Start, 0)[:3])
+}
+
+// checkWriteCoils 写多个线圈的检查
+func (this *conformanceRun) checkWriteCoils() {
+	clause, name, r := "FC15", "写多个线圈", this.Coils
+	if r == nil {
+		this.skip(clause, name, errors.New("未配置地址范围"))
+		return
+	}
+	this.check(clause+".1", name+" 正常响应", func() error {
+		quantity := r.available()
+		if quantity > 10 {
+			quantity = 10
+		}
+		old, err := this.readCoils(r.Start, uint16(quantity))
+		if err != nil {
+			return err
+		}
+		value := make([]bool, len(old))
+		for i := range old {
+			value[i] = !old[i]
+		}
+		return this.verifyCoils(r.Start, value, old, func(value []bool) error {
+			return this.writeCoils(r.Start, value)
+		})
+	})
+	this.check(clause+".2", name+" 数量为0响应非法数据值", func() error {
+		return this.expectException(WriteMultipleCoils, append(addressData(r.Start, 0), 0), IllegalData)
+	})
+	this.check(clause+".3", name+" 数量超过上限响应非法数据值", func() error {
+		return this.expectException(WriteMultipleCoils, append(addressData(r.Start, 1969), CoilsBytes(make([]bool, 1969))...), IllegalData)
+	})
+	this.check(clause+".4", name+" 字节数不一致响应非法数据值", func() error {
+		return this.expectException(WriteMultipleCoils, append(addressData(r.Start, 8), 2, 0, 0), IllegalData)
+	})
+	this.check(clause+".5", name+" 地址溢出响应非法数据地址", func() error {
+		return this.expectException(WriteMultipleCoils, append(addressData(0xFFFF, 2), 1, 0), IllegalAddress)
+	})
+	this.checkOutside(clause+".6", name, WriteMultipleCoils, r, []byte{0, 1, 1, 0})
+	if address, ok := r.last(10); !ok {
+		this.skip(clause+".7", name+" 地址0xFFFF", errors.New("地址范围不包含0xFFFF"))
+	} else {
+		this.check(clause+".7", name+" 地址0xFFFF", func() error {
+			old, err := this.readCoils(address, uint16(65536-int(address)))
+			if err != nil {
+				return err
+			}
+			value := make([]bool, len(old))
+			for i := range old {
+				value[i] = !old[i]
+			}
+			return this.verifyCoils(address, value, old, func(value []bool) error {
+				return this.writeCoils(address, value)
+			})
+		})
+	}
+}
+
+// checkWriteRegisters 写多个寄存器的检查
+func (this *conformanceRun) checkWriteRegisters() {
+	clause, name, r := "FC16", "写多个寄存器", this.HoldingRegisters
+	if r == nil {
+		this.skip(clause, name, errors.New("未配置地址范围"))
+		return
+	}
+	this.check(clause+".1", name+" 正常响应", func() error {
+		quantity := r.available()
+		if quantity > 4 {
+			quantity = 4
+		}
+		old, err := this.readRegisters(r.Start, uint16(quantity))
+		if err != nil {
+			return err
+		}
+		value := make([]uint16, len(old))
+		for i := range old {
+			value[i] = ^old[i]
+		}
+		return this.verifyRegisters(r.Start, value, old, func(value []uint16) error {
+			return this.writeRegisters(r.Start, value)
+		})
+	})
+	this.check(clause+".2", name+" 数量为0响应非法数据值", func() error {
+		return this.expectException(WriteMultipleRegisters, append(addressData(r.Start, 0), 0), IllegalData)
+	})
+	this.check(clause+".3", name+" 数量超过上限响应非法数据值", func() error {
+		//124个寄存器超过帧的最大长度,只声明数量
+		return this.expectException(WriteMultipleRegisters, append(addressData(r.Start, 124), 0), IllegalData)
+	})
+	this.check(clause+".4", name+" 字节数不一致响应非法数据值", func() error {
+		return this.expectException(WriteMultipleRegisters, append(addressData(r.Start, 2), 2, 0, 0), IllegalData)
+	})
+	this.check(clause+".5", name+" 地址溢出响应非法数据地址", func() error {
+		return this.expectException(WriteMultipleRegisters, append(addressData(0xFFFF, 2), 4, 0, 0, 0, 0), IllegalAddress)
+	})
+	this.checkOutside(clause+".6", name, WriteMultipleRegisters, r, []byte{0, 1, 2, 0, 0})
+	if address, ok := r.last(4); !ok {
+		this.skip(clause+".7", name+" 地址0xFFFF", errors.New("地址范围不包含0xFFFF"))
+	} else {
+		this.check(clause+".7", name+" 地址0xFFFF", func() error {
+			old, err := this.readRegisters(address, uint16(65536-int(address)))
+			if err != nil {
+				return err
+			}
+			value := make([]uint16, len(old))
+			for i := range old {
+				value[i] = ^old[i]
+			}
+			return this.verifyRegisters(address, value, old, func(value []uint16) error {
+				return this.writeRegisters(address, value)
+			})
+		})
+	}
+}
+
+// checkBroadcast RTU广播写入生效且从站不响应
+func (this *conformanceRun) checkBroadcast() {
+	clause, name, r := "BC.1", "广播写单个寄存器 生效且不响应", this.HoldingRegisters
+	switch {
+	case this.Transport != RTU:
+		this.skip(clause, name, errors.New("只有RTU支持广播"))
+	case !this.Broadcast:
+		this.skip(clause, name, errors.New("未启用广播检查"))
+	case r == nil:
+		this.skip(clause, name, errors.New("未配置保持寄存器"))
+	default:
+		this.check(clause, name, func() error {
+			old, err := this.readRegisters(r.Start, 1)
+			if err != nil {
+				return err
+			}
+			return this.verifyRegisters(r.Start, []uint16{^old[0]}, old, func(value []uint16) error {
+				if _, err := this.exchange(0, WriteRegisters, addressData(r.Start, value[0])); err != nil {
+					return err
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// checkOutside 超出配置的地址范围时响应非法数据地址,data为地址之后的数据
+func (this *conformanceRun) checkOutside(clause, name string, control Control, r *AddressRange, data []byte) {
+	name += " 超出地址范围响应非法数据地址"
+	address, ok := r.outside()
+	if !ok {
+		this.skip(clause, name, errors.New("整个地址空间都可以访问"))
+		return
+	}
+	this.check(clause, name, func() error {
+		return this.expectException(control, append([]byte{byte(address >> 8), byte(address)}, data...), IllegalAddress)
+	})
+}
+
+// checkLength 数据长度错误时响应非法数据值,RTU按功能码确定帧长度,无法检查
+func (this *conformanceRun) checkLength(clause, name string, control Control, data []byte) {
+	name += " 数据长度错误响应非法数据值"
+	if this.Transport == RTU {
+		this.skip(clause, name, errors.New("RTU按功能码确定帧长度"))
+		return
+	}
+	this.check(clause, name, func() error {
+		return this.expectException(control, data, IllegalData)
+	})
+}
+
+func (this *conformanceRun) check(clause, name string, fn func() error) {
+	err := fn()
+	this.report.Results = append(this.report.Results, &ConformanceResult{Clause: clause, Name: name, Pass: err == nil, Err: err})
+}
+
+func (this *conformanceRun) skip(clause, name string, reason error) {
+	this.report.Results = append(this.report.Results, &ConformanceResult{Clause: clause, Name: name, Skip: true, Err: reason})
+}
+
+// expectNormal 期望正常响应,按请求校验响应
+func (this *conformanceRun) expectNormal(control Control, data []byte) (Frame, error) {
+	req, err := this.exchange(this.Slave, control, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := Validate(req[0], req[1]); err != nil {
+		return nil, err
+	}
+	return req[1], nil
+}
+
+// expectException 期望异常响应,功能码为请求的功能码+0x80,数据域只有1个字节的异常码
+func (this *conformanceRun) expectException(control Control, data []byte, code Control) error {
+	frames, err := this.exchange(this.Slave, control, data)
+	if err != nil {
+		return err
+	}
+	resp := frames[1]
+	if resp.GetControl() != control|0x80 {
+		return fmt.Errorf("期望功能码%#x,实际%#x", byte(control|0x80), byte(resp.GetControl()))
+	}
+	if len(resp.GetData()) != 1 {
+		return fmt.Errorf("异常响应的数据域应为1个字节,实际%d个", len(resp.GetData()))
+	}
+	if e := exception(resp.GetControl(), resp.GetData()); e != code {
+		return fmt.Errorf("期望异常码%#x(%v),实际%#x(%v)", code.Byte()&0x7F, code, e.Byte()&0x7F, e)
+	}
+	return nil
+}
+
+func (this *conformanceRun) readCoils(address, quantity uint16) ([]bool, error) {
+	resp, err := this.expectNormal(ReadCoils, addressData(address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	return BytesToCoils(resp.GetData()[1:], int(quantity)), nil
+}
+
+func (this *conformanceRun) readRegisters(address, quantity uint16) ([]uint16, error) {
+	resp, err := this.expectNormal(ReadHoldingRegisters, addressData(address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	return BytesToRegisters(resp.GetData()[1:]), nil
+}
+
+func (this *conformanceRun) writeCoils(address uint16, value []bool) error {
+	_, err := this.expectNormal(WriteMultipleCoils, append(addressData(address, uint16(len(value))), CoilsBytes(value)...))
+	return err
+}
+
+func (this *conformanceRun) writeRegisters(address uint16, value []uint16) error {
+	bs := RegistersToBytes(value)
+	_, err := this.expectNormal(WriteMultipleRegisters, append(append(addressData(address, uint16(len(value))), byte(len(bs))), bs...))
+	return err
+}
+
+// verifyCoils 写入后读取确认,最后恢复原值
+func (this *conformanceRun) verifyCoils(address uint16, value, old []bool, write func([]bool) error) error {
+	if err := write(value); err != nil {
+		return err
+	}
+	result, err := this.readCoils(address, uint16(len(value)))
+	if err == nil {
+		for i := range value {
+			if result[i] != value[i] {
+				err = fmt.Errorf("写入%v,读取%v", value, result)
+				break
+			}
+		}
+	}
+	if e := this.writeCoils(address, old); err == nil && e != nil {
+		err = fmt.Errorf("恢复原值失败:%v", e)
+	}
+	return err
+}
+
+// verifyRegisters 写入后读取确认,最后恢复原值
+func (this *conformanceRun) verifyRegisters(address uint16, value, old []uint16, write func([]uint16) error) error {
+	if err := write(value); err != nil {
+		return err
+	}
+	result, err := this.readRegisters(address, uint16(len(value)))
+	if err == nil {
+		for i := range value {
+			if result[i] != value[i] {
+				err = fmt.Errorf("写入%v,读取%v", value, result)
+				break
+			}
+		}
+	}
+	if e := this.writeRegisters(address, old); err == nil && e != nil {
+		err = fmt.Errorf("恢复原值失败:%v", e)
+	}
+	return err
+}
+
+// exchange 发送请求并读取一帧响应,返回请求和响应,广播时确认没有响应
+func (this *conformanceRun) exchange(slave byte, control Control, data []byte) ([2]Frame, error) {
+	var req Frame
+	switch this.Transport {
+	case TCP:
+		this.order++
+		req = &TCPFrame{Order: [2]byte{byte(this.order >> 8), byte(this.order)}, Slave: slave, Control: control}
+	case RTU:
+		req = &RTUFrame{Slave: slave, Control: control}
+	default:
+		return [2]Frame{}, errors.New("未知Modbus类型:" + this.Transport)
+	}
+	req.SetData(data)
+	this.discard()
+	if _, err := this.conn.Write(req.Bytes()); err != nil {
+		return [2]Frame{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(this.ctx, this.timeout)
+	defer cancel()
+	broadcast := this.Transport == RTU && slave == 0
+	var bytes []byte
+	for {
+		select {
+		case <-ctx.Done():
+			if broadcast && this.ctx.Err() == nil {
+				return [2]Frame{req, nil}, nil
+			}
+			if this.ctx.Err() == nil {
+				return [2]Frame{}, ErrTimeout
+			}
+			return [2]Frame{}, ctx.Err()
+		case bs, ok := <-this.read:
+			if !ok {
+				return [2]Frame{}, this.readErr
+			}
+			if broadcast {
+				return [2]Frame{}, errors.New("广播不应响应")
+			}
+			bytes = append(bytes, bs...)
+			if n := this.length(bytes); n > 0 && len(bytes) >= n {
+				resp, err := this.decode(bytes[:n])
+				if err != nil {
+					return [2]Frame{}, err
+				}
+				return [2]Frame{req, resp}, nil
+			}
+		}
+	}
+}
+
+// length 响应帧的长度,数据不足时返回0
+func (this *conformanceRun) length(bytes []byte) int {
+	if this.Transport == RTU {
+		return rtuFrameLength(bytes)
+	}
+	if len(bytes) < 6 {
+		return 0
+	}
+	return 6 + (int(bytes[4])<<8 | int(bytes[5]))
+}
+
+func (this *conformanceRun) decode(bytes []byte) (Frame, error) {
+	if this.Transport == RTU {
+		return DecodeRTU(bytes)
+	}
+	f, err := DecodeTCP(bytes)
+	if _, ok := err.(Control); ok {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// discard 丢弃之前残余的数据
+func (this *conformanceRun) discard() {
+	for {
+		select {
+		case _, ok := <-this.read:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// runRead 持续读取数据,直到连接关闭或者测试结束
+func (this *conformanceRun) runRead() {
+	defer close(this.read)
+	buf := make([]byte, 256)
+	for {
+		n, err := this.conn.Read(buf)
+		if n > 0 {
+			select {
+			case this.read <- CopyBytes(buf[:n]):
+			case <-this.done:
+				return
+			}
+		}
+		if err != nil {
+			this.readErr = err
+			return
+		}
+	}
+}
+
+// addressData 起始地址和数量(或值)的请求数据
+func addressData(address, value uint16) []byte {
+	return []byte{byte(address >> 8), byte(address), byte(value >> 8), byte(value)}
+}
@@ -0,0 +1,69 @@
+package modbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConformance(t *testing.T) {
+	memory, _, _ := newMemoryServer(20)
+	memory.SetMemory(NewMemory())
+	mapped, _, _ := newMemoryServer(20)
+	//地址空间末尾的地址
+	registers, coils := make([]uint16, 10), make([]bool, 10)
+	for i := range registers {
+		i := i
+		mapped.SetHoldingRegisters(uint16(0xFFF6+i), ReadWriteRegister{
+			Read:  func() ([2]byte, error) { return [2]byte{byte(registers[i] >> 8), byte(registers[i])}, nil },
+			Write: func(b [2]byte) error { registers[i] = uint16(b[0])<<8 | uint16(b[1]); return nil },
+		})
+		mapped.SetCoils(uint16(0xFFF6+i), ReadWriteCoils{
+			Read:  func() (bool, error) { return coils[i], nil },
+			Write: func(b bool) error { coils[i] = b; return nil },
+		})
+	}
+	for _, s := range []*Server{memory, mapped} {
+		for _, transport := range []string{TCP, RTU} {
+			conn, err := s.Pipe(transport, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &Conformance{
+				Transport:        transport,
+				Slave:            1,
+				Coils:            &AddressRange{},
+				DiscreteInputs:   &AddressRange{},
+				InputRegisters:   &AddressRange{},
+				HoldingRegisters: &AddressRange{},
+				Broadcast:        true,
+				Timeout:          100 * time.Millisecond,
+			}
+			report := c.Run(context.Background(), conn)
+			conn.Close()
+			if !report.Passed() {
+				t.Error(transport, "\n", report)
+			}
+		}
+	}
+
+	//地址0被拒绝时应检查出来
+	s := NewServer().SetMemory(NewMemory())
+	s.SetHandler(5, func(f Frame) ([]byte, Control) {
+		if data := f.GetData(); len(data) == 4 && data[0] == 0 && data[1] == 0 && data[3] == 0 {
+			return nil, IllegalAddress
+		}
+		return s.handler5(f)
+	})
+	conn, err := s.Pipe(TCP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &Conformance{Transport: TCP, Slave: 1, Coils: &AddressRange{}}
+	report := c.Run(context.Background(), conn)
+	failed := report.Failed()
+	if len(failed) != 1 || failed[0].Clause != "FC05.1" {
+		t.Error(report)
+	}
+}
@@ -0,0 +1,269 @@
+package modbus
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 数据帧的类型
+const (
+	KindRequest   = "request"   //请求
+	KindResponse  = "response"  //正常响应
+	KindException = "exception" //异常响应
+)
+
+// MBAP Modbus/TCP的报文头
+type MBAP struct {
+	Transaction uint16 `json:"transaction"` //事务号
+	Protocol    uint16 `json:"protocol"`    //协议号
+	Length      uint16 `json:"length"`      //长度
+	Unit        byte   `json:"unit"`        //单元标识(从站地址)
+}
+
+// Dissection 数据帧的解析结果,字段为nil表示该功能码没有这个字段
+type Dissection struct {
+	Transport     string   `json:"transport"`                //"TCP" or "RTU"
+	MBAP          *MBAP    `json:"mbap,omitempty"`           //TCP的报文头
+	CRC           string   `json:"crc,omitempty"`            //RTU的CRC
+	Unit          byte     `json:"unit"`                     //从站地址
+	Function      byte     `json:"fc"`                       //功能码,异常响应为原功能码
+	FunctionName  string   `json:"function"`                 //功能码名称
+	Kind          string   `json:"kind"`                     //KindRequest KindResponse KindException
+	Address       *uint16  `json:"address,omitempty"`        //起始地址,读写多个寄存器时为读的起始地址
+	Quantity      *uint16  `json:"quantity,omitempty"`       //数量,读写多个寄存器时为读的数量
+	WriteAddress  *uint16  `json:"write_address,omitempty"`  //读写多个寄存器时写的起始地址
+	WriteQuantity *uint16  `json:"write_quantity,omitempty"` //读写多个寄存器时写的数量
+	ByteCount     *int     `json:"byte_count,omitempty"`     //字节数
+	Value         *uint16  `json:"value,omitempty"`          //写单个线圈或寄存器的值
+	AndMask       *uint16  `json:"and_mask,omitempty"`       //屏蔽写的AND屏蔽
+	OrMask        *uint16  `json:"or_mask,omitempty"`        //屏蔽写的OR屏蔽
+	Registers     []uint16 `json:"registers,omitempty"`      //寄存器的值
+	Coils         []bool   `json:"coils,omitempty"`          //线圈的值,按字节数展开,包含填充位
+	Exception     *byte    `json:"exception,omitempty"`      //异常码
+	ExceptionName string   `json:"exception_name,omitempty"` //异常码名称
+	Data          string   `json:"data,omitempty"`           //无法按功能码解析时的原始数据
+	Error         string   `json:"error,omitempty"`          //格式错误
+}
+
+var functionNames = map[Control]string{
+	ReadCoils:                  "ReadCoils",
+	ReadDiscreteInputs:         "ReadDiscreteInputs",
+	ReadHoldingRegisters:       "ReadHoldingRegisters",
+	ReadInputRegisters:         "ReadInputRegisters",
+	WriteCoils:                 "WriteSingleCoil",
+	WriteRegisters:             "WriteSingleRegister",
+	WriteMultipleCoils:         "WriteMultipleCoils",
+	WriteMultipleRegisters:     "WriteMultipleRegisters",
+	ReadFileLog:                "ReadFileRecord",
+	WriteFileLog:               "WriteFileRecord",
+	MaskWriteRegisters:         "MaskWriteRegister",
+	ReadWriteMultipleRegisters: "ReadWriteMultipleRegisters",
+}
+
+var exceptionNames = map[byte]string{
+	0x01: "IllegalFunction",
+	0x02: "IllegalDataAddress",
+	0x03: "IllegalDataValue",
+	0x04: "ServerDeviceFailure",
+	0x05: "Acknowledge",
+	0x06: "ServerDeviceBusy",
+	0x08: "MemoryParityError",
+	0x0A: "GatewayPathUnavailable",
+	0x0B: "GatewayTargetNoResponse",
+}
+
+// FunctionName 功能码名称,未知功能码返回 "Function(0x2B)"
+func FunctionName(control Control) string {
+	if name, ok := functionNames[control]; ok {
+		return name
+	}
+	return fmt.Sprintf("Function(0x%02X)", byte(control))
+}
+
+// ExceptionName 异常码名称,code为异常码(例 0x02)
+func ExceptionName(code byte) string {
+	if name, ok := exceptionNames[code&0x7F]; ok {
+		return name
+	}
+	return fmt.Sprintf("Exception(0x%02X)", code)
+}
+
+// Dissect 解析数据帧,request表示是请求还是响应(读请求和读响应无法根据数据区分)
+func Dissect(f Frame, request bool) *Dissection {
+	if r, ok := f.(*Request); ok {
+		f = r.Frame
+	}
+	control, data := f.GetControl(), f.GetData()
+	d := &Dissection{
+		Transport:    f.Type(),
+		Unit:         f.GetSlave(),
+		Function:     byte(control) & 0x7F,
+		FunctionName: FunctionName(control & 0x7F),
+		Kind:         KindResponse,
+	}
+	if request {
+		d.Kind = KindRequest
+	}
+	if t, ok := f.(*TCPFrame); ok {
+		d.MBAP = &MBAP{
+			Transaction: uint16(t.Order[0])<<8 | uint16(t.Order[1]),
+			Protocol:    uint16(t.Protocol[0])<<8 | uint16(t.Protocol[1]),
+			Length:      uint16(t.Length[0])<<8 | uint16(t.Length[1]),
+			Unit:        t.Slave,
+		}
+	}
+	if rtu, ok := f.(*RTUFrame); ok {
+		bs := rtu.Bytes()
+		d.CRC = hex.EncodeToString(bs[len(bs)-2:])
+	}
+	u16 := func(i int) *uint16 {
+		v := uint16(data[i])<<8 | uint16(data[i+1])
+		return &v
+	}
+	short := func(n int) bool {
+		if len(data) < n {
+			d.Error = fmt.Sprintf("数据长度%d,至少需要%d", len(data), n)
+			d.Data = hex.EncodeToString(data)
+			return true
+		}
+		return false
+	}
+	byteCount := func(i int) bool {
+		if short(i + 1) {
+			return false
+		}
+		n := int(data[i])
+		d.ByteCount = &n
+		if len(data) != i+1+n {
+			d.Error = fmt.Sprintf("字节数%d和数据长度%d不一致", n, len(data)-i-1)
+			return false
+		}
+		return true
+	}
+
+	if !request && byte(control) > 0x80 {
+		d.Kind = KindException
+		code := byte(control) & 0x7F
+		if len(data) > 0 {
+			code = data[0]
+		} else {
+			//非标准的异常响应,功能码为0x80加异常码
+			d.Function, d.FunctionName = 0, ""
+		}
+		d.Exception, d.ExceptionName = &code, ExceptionName(code)
+		return d
+	}
+
+	switch control {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters:
+		if request {
+			if !short(4) {
+				d.Address, d.Quantity = u16(0), u16(2)
+			}
+		} else if byteCount(0) {
+			if control == ReadCoils || control == ReadDiscreteInputs {
+				d.Coils = BytesToCoils(data[1:], len(data[1:])*8)
+			} else {
+				d.Registers = BytesToRegisters(data[1:])
+			}
+		}
+	case WriteCoils, WriteRegisters:
+		if !short(4) {
+			d.Address, d.Value = u16(0), u16(2)
+		}
+	case WriteMultipleCoils, WriteMultipleRegisters:
+		if short(4) {
+			break
+		}
+		d.Address, d.Quantity = u16(0), u16(2)
+		if request && byteCount(4) {
+			if control == WriteMultipleCoils {
+				d.Coils = BytesToCoils(data[5:], int(*d.Quantity))
+			} else {
+				d.Registers = BytesToRegisters(data[5:])
+			}
+		}
+	case MaskWriteRegisters:
+		if !short(6) {
+			d.Address, d.AndMask, d.OrMask = u16(0), u16(2), u16(4)
+		}
+	case ReadWriteMultipleRegisters:
+		if !request {
+			if byteCount(0) {
+				d.Registers = BytesToRegisters(data[1:])
+			}
+		} else if !short(8) {
+			d.Address, d.Quantity, d.WriteAddress, d.WriteQuantity = u16(0), u16(2), u16(4), u16(6)
+			if byteCount(8) {
+				d.Registers = BytesToRegisters(data[9:])
+			}
+		}
+	default:
+		d.Data = hex.EncodeToString(data)
+	}
+	return d
+}
+
+// String 一行摘要,例 TCP tid=1 unit=1 ReadHoldingRegisters request addr=0 qty=2
+func (this *Dissection) String() string {
+	b := &strings.Builder{}
+	b.WriteString(this.Transport)
+	if this.MBAP != nil {
+		fmt.Fprintf(b, " tid=%d", this.MBAP.Transaction)
+		if this.MBAP.Protocol != 0 {
+			fmt.Fprintf(b, " pid=%d", this.MBAP.Protocol)
+		}
+	}
+	fmt.Fprintf(b, " unit=%d", this.Unit)
+	if this.FunctionName != "" {
+		fmt.Fprintf(b, " %s", this.FunctionName)
+	}
+	b.WriteString(" " + this.Kind)
+	if this.Exception != nil {
+		fmt.Fprintf(b, " code=%d %s", *this.Exception, this.ExceptionName)
+	}
+	field := func(name string, v *uint16) {
+		if v != nil {
+			fmt.Fprintf(b, " %s=%d", name, *v)
+		}
+	}
+	field("addr", this.Address)
+	field("qty", this.Quantity)
+	field("write_addr", this.WriteAddress)
+	field("write_qty", this.WriteQuantity)
+	if this.ByteCount != nil {
+		fmt.Fprintf(b, " bytes=%d", *this.ByteCount)
+	}
+	field("value", this.Value)
+	if this.AndMask != nil {
+		fmt.Fprintf(b, " and=0x%04X or=0x%04X", *this.AndMask, *this.OrMask)
+	}
+	if this.Registers != nil {
+		fmt.Fprintf(b, " registers=%v", this.Registers)
+	}
+	if this.Coils != nil {
+		b.WriteString(" coils=")
+		for _, c := range this.Coils {
+			if c {
+				b.WriteByte('1')
+			} else {
+				b.WriteByte('0')
+			}
+		}
+	}
+	if this.Data != "" {
+		fmt.Fprintf(b, " data=%s", this.Data)
+	}
+	if this.Error != "" {
+		fmt.Fprintf(b, " error=%q", this.Error)
+	}
+	return b.String()
+}
+
+// JSON 解析结果的JSON
+func (this *Dissection) JSON() []byte {
+	bs, _ := json.Marshal(this)
+	return bs
+}
@@ -0,0 +1,44 @@
+package modbus
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestDissect(t *testing.T) {
+	tcp := func(s string) Frame {
+		bs, _ := hex.DecodeString(s)
+		f, err := DecodeTCP(bs)
+		if err != nil {
+			if _, ok := err.(Control); !ok {
+				t.Fatal(s, err)
+			}
+		}
+		return f
+	}
+	for _, c := range []struct {
+		f       Frame
+		request bool
+		summary string
+	}{
+		{tcp("000100000006010300000002"), true, "TCP tid=1 unit=1 ReadHoldingRegisters request addr=0 qty=2"},
+		{tcp("00010000000701030400010002"), false, "TCP tid=1 unit=1 ReadHoldingRegisters response bytes=4 registers=[1 2]"},
+		{tcp("000200000003018302"), false, "TCP tid=2 unit=1 ReadHoldingRegisters exception code=2 IllegalDataAddress"},
+		{tcp("0003000000090110000a00010200ff"), true, "TCP tid=3 unit=1 WriteMultipleRegisters request addr=10 qty=1 bytes=2 registers=[255]"},
+		{&RTUFrame{Slave: 2, Control: WriteCoils, Data: []byte{0, 5, 0xFF, 0}}, true, "RTU unit=2 WriteSingleCoil request addr=5 value=65280"},
+		{&RTUFrame{Slave: 2, Control: ReadCoils, Data: []byte{1, 0x05}}, false, "RTU unit=2 ReadCoils response bytes=1 coils=10100000"},
+		{&RTUFrame{Slave: 2, Control: MaskWriteRegisters, Data: []byte{0, 4, 0, 0xF2, 0, 0x25}}, true, "RTU unit=2 MaskWriteRegister request addr=4 and=0x00F2 or=0x0025"},
+		{&RTUFrame{Slave: 2, Control: ReadHoldingRegisters, Data: []byte{0, 1}}, true, `RTU unit=2 ReadHoldingRegisters request data=0001 error="数据长度2,至少需要4"`},
+		{&RTUFrame{Slave: 2, Control: 0x2B, Data: []byte{0x0E, 1}}, true, "RTU unit=2 Function(0x2B) request data=0e01"},
+	} {
+		d := Dissect(c.f, c.request)
+		if d.String() != c.summary {
+			t.Errorf("期望 %s\n实际 %s", c.summary, d)
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(d.JSON(), &m); err != nil || m["transport"] != c.f.Type() {
+			t.Error(string(d.JSON()), err)
+		}
+	}
+}
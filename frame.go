@@ -1,11 +1,17 @@
 package modbus
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 )
 
+var (
+	// ErrCRC RTU数据CRC校验错误
+	ErrCRC = errors.New("crc校验错误")
+)
+
 type Frame interface {
 
 	// Type 类型2种 "TCP" or "RTU"
@@ -60,11 +66,16 @@ func (this *RTUFrame) HEX() string {
 }
 
 func (this *RTUFrame) Bytes() []byte {
-	bytes := []byte(nil)
-	bytes = append(bytes, this.Slave, this.Control.Byte())
-	bytes = append(bytes, this.Data...)
-	bytes = append(bytes, CRC(bytes)...)
-	return bytes
+	return this.AppendBytes(make([]byte, 0, len(this.Data)+4))
+}
+
+// AppendBytes 编码后追加到dst,dst容量足够时不分配内存
+func (this *RTUFrame) AppendBytes(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, this.Slave, this.Control.Byte())
+	dst = append(dst, this.Data...)
+	crc := CRC16(dst[start:])
+	return append(dst, byte(crc), byte(crc>>8))
 }
 
 func (this *RTUFrame) GetSlave() byte {
@@ -92,33 +103,37 @@ func (this *RTUFrame) SetData(data []byte) {
 }
 
 func EncodeRTU(slave byte, control Control, data []byte) []byte {
-	f := &RTUFrame{
-		Slave:   slave,
-		Control: control,
-		Data:    data,
-	}
-	return f.Bytes()
+	return AppendRTU(make([]byte, 0, len(data)+4), slave, control, data)
+}
+
+// AppendRTU 编码RTU数据帧后追加到dst,dst容量足够时不分配内存
+func AppendRTU(dst []byte, slave byte, control Control, data []byte) []byte {
+	f := RTUFrame{Slave: slave, Control: control, Data: data}
+	return f.AppendBytes(dst)
 }
 
 func DecodeRTU(bytes []byte) (*RTUFrame, error) {
+	f := &RTUFrame{}
+	if err := f.Decode(bytes); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Decode 解码到当前数据帧,数据域和CRC引用bytes,不分配内存
+func (this *RTUFrame) Decode(bytes []byte) error {
 	length := len(bytes)
 	if length < 5 {
-		return nil, errors.New("数据长度异常(小于5):" + hex.EncodeToString(bytes))
+		return errors.New("数据长度异常(小于5):" + hex.EncodeToString(bytes))
 	}
-	crc := CRC(bytes[:length-2])
-	if len(crc) != 2 || (crc[0] != bytes[length-2:][0] && crc[1] != bytes[length-2:][1]) {
-		return nil, errors.New(fmt.Sprintf("crc校验错误:%s", hex.EncodeToString(bytes)))
+	if CRC16(bytes[:length-2]) != binary.LittleEndian.Uint16(bytes[length-2:]) {
+		return fmt.Errorf("%w:%s", ErrCRC, hex.EncodeToString(bytes))
 	}
-	if hex.EncodeToString(CRC(bytes[:len(bytes)-2])) != hex.EncodeToString(bytes[len(bytes)-2:]) {
-		return nil, fmt.Errorf("CRC校验结果不一致%s", hex.EncodeToString(bytes))
-	}
-	bytes = bytes[:len(bytes)-2]
-	return &RTUFrame{
-		Slave:   bytes[0],
-		Control: Control(bytes[1]),
-		Data:    bytes[2:],
-		CRC:     crc,
-	}, nil
+	this.Slave = bytes[0]
+	this.Control = Control(bytes[1])
+	this.Data = bytes[2 : length-2 : length-2]
+	this.CRC = bytes[length-2:]
+	return nil
 }
 
 type TCPFrame struct {
@@ -144,13 +159,18 @@ func (this *TCPFrame) HEX() string {
 }
 
 func (this *TCPFrame) Bytes() []byte {
-	bytes := []byte(nil)
-	bytes = append(bytes, this.Order[0], this.Order[1])
-	bytes = append(bytes, this.Protocol[0], this.Protocol[1])
-	bytes = append(bytes, this.Length[0], this.Length[1])
-	bytes = append(bytes, this.Slave, this.Control.Byte())
-	bytes = append(bytes, this.Data...)
-	return bytes
+	return this.AppendBytes(make([]byte, 0, len(this.Data)+8))
+}
+
+// AppendBytes 编码后追加到dst,dst容量足够时不分配内存
+func (this *TCPFrame) AppendBytes(dst []byte) []byte {
+	dst = append(dst,
+		this.Order[0], this.Order[1],
+		this.Protocol[0], this.Protocol[1],
+		this.Length[0], this.Length[1],
+		this.Slave, this.Control.Byte(),
+	)
+	return append(dst, this.Data...)
 }
 
 func (this *TCPFrame) GetSlave() byte {
@@ -180,35 +200,43 @@ func (this *TCPFrame) SetData(data []byte) {
 }
 
 func EncodeTCP(slave byte, control Control, data []byte) []byte {
-	f := &TCPFrame{
-		Order:    [2]byte{0x01, 0x00},
-		Protocol: [2]byte{},
-		Length:   [2]byte{0x00, 0x06},
-		Slave:    slave,
-		Control:  control,
-		Data:     data,
-	}
-	return f.Bytes()
+	return AppendTCP(make([]byte, 0, len(data)+8), 0x0100, slave, control, data)
+}
+
+// AppendTCP 编码TCP数据帧后追加到dst,长度根据数据域计算,dst容量足够时不分配内存
+func AppendTCP(dst []byte, order uint16, slave byte, control Control, data []byte) []byte {
+	n := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0, 0, slave, control.Byte())
+	binary.BigEndian.PutUint16(dst[n:], order)
+	binary.BigEndian.PutUint16(dst[n+4:], uint16(len(data)+2))
+	return append(dst, data...)
 }
 
 func DecodeTCP(bytes []byte) (*TCPFrame, error) {
-	length := len(bytes)
-	if length < 9 {
+	if len(bytes) < 9 {
 		return nil, errors.New("数据长度异常(小于9):" + hex.EncodeToString(bytes))
 	}
-	f := &TCPFrame{
-		Order:    [2]byte{bytes[0], bytes[1]},
-		Protocol: [2]byte{bytes[2], bytes[3]},
-		Length:   [2]byte{bytes[4], bytes[5]},
-		Slave:    bytes[6],
-		Control:  Control(bytes[7]),
-		Data:     bytes[8:],
+	f := &TCPFrame{}
+	return f, f.Decode(bytes)
+}
+
+// Decode 解码到当前数据帧,数据域引用bytes,不分配内存
+// 异常响应返回异常码,长度和报文头不一致时返回错误,两种情况都会解码
+func (this *TCPFrame) Decode(bytes []byte) error {
+	if len(bytes) < 9 {
+		return errors.New("数据长度异常(小于9):" + hex.EncodeToString(bytes))
 	}
-	if f.Control.Byte() > 0x80 {
-		return f, f.Control
+	this.Order = [2]byte{bytes[0], bytes[1]}
+	this.Protocol = [2]byte{bytes[2], bytes[3]}
+	this.Length = [2]byte{bytes[4], bytes[5]}
+	this.Slave = bytes[6]
+	this.Control = Control(bytes[7])
+	this.Data = bytes[8:]
+	if e := exception(this.Control, this.Data); e != Success {
+		return e
 	}
-	if int(f.Length[0])*256+int(f.Length[1]) != len(f.Data)+2 {
-		return f, errors.New("数据长度错误:" + f.HEX())
+	if int(binary.BigEndian.Uint16(bytes[4:])) != len(this.Data)+2 {
+		return errors.New("数据长度错误:" + this.HEX())
 	}
-	return f, nil
+	return nil
 }
@@ -251,6 +251,18 @@ func (this Control) Byte() byte {
 	return byte(this)
 }
 
+// exception 解析异常响应的异常码,正常响应返回Success
+// 标准的异常响应为 功能码+0x80,数据域为异常码,例 0x83 0x02 >>> IllegalAddress
+func exception(control Control, data []byte) Control {
+	if control.Byte() <= 0x80 {
+		return Success
+	}
+	if len(data) > 0 {
+		return Control(0x80 | data[0])
+	}
+	return control
+}
+
 func (this Control) Error() string {
 	switch this {
 	case IllegalFunction:
@@ -2,6 +2,7 @@ package modbus
 
 import (
 	"encoding/hex"
+	"errors"
 	"testing"
 )
 
@@ -51,3 +52,73 @@ func TestNewTCPFrame1(t *testing.T) {
 	}
 	t.Log(hex.EncodeToString(f.GetData()))
 }
+
+func TestFrameCodec(t *testing.T) {
+	data := []byte{0, 1, 0, 10}
+	if bs := AppendRTU(nil, 1, ReadHoldingRegisters, data); hex.EncodeToString(bs) != "01030001000a940d" {
+		t.Error(hex.EncodeToString(bs))
+	}
+	if bs := AppendTCP(nil, 0x0100, 1, ReadHoldingRegisters, data); hex.EncodeToString(bs) != "01000000000601030001000a" {
+		t.Error(hex.EncodeToString(bs))
+	}
+	bs, _ := hex.DecodeString("01030400000063ba1a")
+	bs[len(bs)-1] ^= 1
+	if _, err := DecodeRTU(bs); !errors.Is(err, ErrCRC) {
+		t.Error("CRC错误时应返回ErrCRC", err)
+	}
+
+	//使用调用者的缓存和数据帧时不分配内存
+	buf := make([]byte, 0, 260)
+	rtu, tcp := &RTUFrame{}, &TCPFrame{}
+	response, _ := hex.DecodeString("01030400000063ba1a")
+	for name, fn := range map[string]func(){
+		"AppendRTU": func() { buf = AppendRTU(buf[:0], 1, ReadHoldingRegisters, data) },
+		"AppendTCP": func() { buf = AppendTCP(buf[:0], 1, 1, ReadHoldingRegisters, data) },
+		"DecodeRTU": func() { rtu.Decode(response) },
+		"DecodeTCP": func() { tcp.Decode(buf) },
+		"RTUFrame":  func() { buf = rtu.AppendBytes(buf[:0]) },
+	} {
+		buf = AppendTCP(buf[:0], 1, 1, ReadHoldingRegisters, data)
+		if n := testing.AllocsPerRun(100, fn); n != 0 {
+			t.Errorf("%s 分配了%v次内存", name, n)
+		}
+	}
+}
+
+func BenchmarkAppendRTU(b *testing.B) {
+	buf, data := make([]byte, 0, 256), []byte{0, 1, 0, 10}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = AppendRTU(buf[:0], 1, ReadHoldingRegisters, data)
+	}
+}
+
+func BenchmarkDecodeRTU(b *testing.B) {
+	bs := EncodeRTU(1, ReadHoldingRegisters, append([]byte{20}, make([]byte, 20)...))
+	f := &RTUFrame{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := f.Decode(bs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendTCP(b *testing.B) {
+	buf, data := make([]byte, 0, 260), []byte{0, 1, 0, 10}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = AppendTCP(buf[:0], uint16(i), 1, ReadHoldingRegisters, data)
+	}
+}
+
+func BenchmarkDecodeTCP(b *testing.B) {
+	bs := EncodeTCP(1, ReadHoldingRegisters, append([]byte{20}, make([]byte, 20)...))
+	f := &TCPFrame{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := f.Decode(bs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
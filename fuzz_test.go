@@ -0,0 +1,89 @@
+//go:build go1.18
+// +build go1.18
+
+package modbus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func FuzzDecodeRTU(f *testing.F) {
+	for _, s := range []string{"01030400000063ba1a", "010300010001d5ca", "018302c0f1", "0110000100020400010002"} {
+		bs, _ := hex.DecodeString(s)
+		f.Add(bs)
+	}
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		frame, err := DecodeRTU(bs)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(frame.Bytes(), bs) {
+			t.Errorf("重新编码不一致 %x %x", bs, frame.Bytes())
+		}
+		_ = Dissect(frame, true).String()
+		_ = Dissect(frame, false).String()
+	})
+}
+
+func FuzzDecodeTCP(f *testing.F) {
+	for _, s := range []string{"000100000006010300010002", "00010000000501030400010002", "000100000003018302"} {
+		bs, _ := hex.DecodeString(s)
+		f.Add(bs)
+	}
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		frame, err := DecodeTCP(bs)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(frame.Bytes(), bs) {
+			t.Errorf("重新编码不一致 %x %x", bs, frame.Bytes())
+		}
+		_ = Dissect(frame, true).String()
+		_ = Dissect(frame, false).String()
+	})
+}
+
+// FuzzServerHandle 任意请求都不能panic,响应为正常响应或标准的异常响应
+func FuzzServerHandle(f *testing.F) {
+	for _, c := range []struct {
+		control byte
+		data    string
+	}{
+		{1, "00000010"}, {2, "00000010"}, {3, "0000000a"}, {4, "00000001"},
+		{5, "0001ff00"}, {6, "00010003"}, {15, "0001000a02cd01"}, {16, "000100020400010002"},
+		{3, "00"}, {5, ""}, {16, "0001"}, {0x2B, "0e"},
+	} {
+		data, _ := hex.DecodeString(c.data)
+		f.Add(byte(1), c.control, data)
+	}
+	mapped, _, _ := newMemoryServer(20)
+	memory, _, _ := newMemoryServer(20)
+	memory.SetMemory(NewMemory())
+	for _, s := range []*Server{mapped, memory} {
+		s.SetLogger(LoggerFunc(func(Level, string, ...Field) {}))
+	}
+	f.Fuzz(func(t *testing.T, slave, control byte, data []byte) {
+		for _, s := range []*Server{mapped, memory} {
+			for _, req := range []Frame{
+				&RTUFrame{Slave: slave, Control: Control(control), Data: CopyBytes(data)},
+				&TCPFrame{Slave: slave, Control: Control(control), Data: CopyBytes(data)},
+			} {
+				if err := s.handle(req, io.Discard); err != nil {
+					t.Fatal(err)
+				}
+				switch req.GetControl() {
+				case Control(control):
+				case Control(control) | 0x80:
+					if len(req.GetData()) != 1 {
+						t.Errorf("异常响应格式错误 %x", req.Bytes())
+					}
+				default:
+					t.Errorf("响应功能码错误 %x", req.Bytes())
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package modbus
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level 日志等级,数值和log/slog一致
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (this Level) String() string {
+	switch {
+	case this < LevelInfo:
+		return "DEBUG"
+	case this < LevelWarn:
+		return "INFO"
+	case this < LevelError:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// 日志事件
+const (
+	EventConnect      = "connect"        //建立连接
+	EventDisconnect   = "disconnect"     //断开连接
+	EventRx           = "frame_rx"       //收到请求
+	EventTx           = "frame_tx"       //发送响应
+	EventException    = "exception_sent" //发送异常响应
+	EventFramingError = "framing_error"  //数据帧格式错误
+	EventError        = "error"          //其它错误
+)
+
+// 日志字段
+const (
+	FieldPeer      = "peer"      //来源
+	FieldTransport = "transport" //传输方式
+	FieldUnit      = "unit"      //从站地址
+	FieldControl   = "fc"        //功能码
+	FieldCode      = "code"      //异常码
+	FieldLatency   = "latency"   //处理耗时
+	FieldHex       = "hex"       //数据帧
+	FieldFrame     = "frame"     //数据帧的解析结果,见Dissect
+	FieldError     = "error"     //错误
+)
+
+// Field 日志字段
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger 日志接口
+type Logger interface {
+	Log(level Level, event string, fields ...Field)
+}
+
+// LoggerFunc 函数实现Logger
+type LoggerFunc func(level Level, event string, fields ...Field)
+
+func (this LoggerFunc) Log(level Level, event string, fields ...Field) {
+	this(level, event, fields...)
+}
+
+// NewStdLogger 使用标准库log输出,格式 [Modbus][INFO] connect peer=127.0.0.1:502
+// l为nil时使用log的默认输出,低于min等级的日志不输出
+func NewStdLogger(l *log.Logger, min Level) Logger {
+	return LoggerFunc(func(level Level, event string, fields ...Field) {
+		if level < min {
+			return
+		}
+		b := strings.Builder{}
+		fmt.Fprintf(&b, "[Modbus][%s] %s", level, event)
+		for _, f := range fields {
+			fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+		}
+		if l == nil {
+			log.Println(b.String())
+			return
+		}
+		l.Println(b.String())
+	})
+}
+
+// SetLogger 设置日志,未设置时调试模式下使用标准库log输出
+func (this *Server) SetLogger(l Logger) *Server {
+	this.logger = l
+	return this
+}
+
+// SetTrace 设置追踪钩子,包裹每个请求的处理,next执行访问控制,处理函数和发送响应
+// 可以用来计时或添加追踪,必须调用next,返回next的错误
+func (this *Server) SetTrace(fn func(f Frame, next func() error) error) *Server {
+	this.trace = fn
+	return this
+}
+
+// log 输出日志
+func (this *Server) log(level Level, event string, fields ...Field) {
+	if this.logger != nil {
+		this.logger.Log(level, event, fields...)
+	} else if this.debug {
+		stdLogger.Log(level, event, fields...)
+	}
+}
+
+// logging 是否需要输出日志,避免生成不需要的字段
+func (this *Server) logging() bool {
+	return this.logger != nil || this.debug
+}
+
+var stdLogger = NewStdLogger(nil, LevelDebug)
+
+// frameFields 请求的公共字段
+func frameFields(f Frame) []Field {
+	fields := make([]Field, 0, 8)
+	if r, ok := f.(*Request); ok {
+		fields = append(fields, Field{FieldPeer, r.Peer}, Field{FieldTransport, r.Transport})
+	}
+	return append(fields, Field{FieldUnit, f.GetSlave()}, Field{FieldControl, byte(f.GetControl())})
+}
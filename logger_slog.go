@@ -0,0 +1,23 @@
+//go:build go1.21
+// +build go1.21
+
+package modbus
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlogLogger 使用log/slog输出,事件为消息,字段为属性,l为nil时使用slog.Default()
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return LoggerFunc(func(level Level, event string, fields ...Field) {
+		attrs := make([]slog.Attr, len(fields))
+		for i, f := range fields {
+			attrs[i] = slog.Any(f.Key, f.Value)
+		}
+		l.LogAttrs(context.Background(), slog.Level(level), event, attrs...)
+	})
+}
@@ -0,0 +1,226 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 指标的来源
+const (
+	SideServer = "server"
+	SideClient = "client"
+)
+
+// Metrics 指标接口,客户端和从站在通讯时调用,side为SideServer或SideClient
+type Metrics interface {
+	Request(side string, slave byte, control Control, latency time.Duration) //完成一次请求
+	Exception(side string, code Control)                                     //异常响应
+	CRCError(side string)                                                    //CRC校验错误
+	FramingError(side string)                                                //数据帧格式错误
+	Timeout(side string)                                                     //响应超时
+	Retry(side string)                                                       //重试
+	Connection(side string, delta int)                                       //连接数量变化
+}
+
+// SetMetrics 设置指标
+func (this *Server) SetMetrics(m Metrics) *Server {
+	this.metrics = m
+	return this
+}
+
+// SetMetrics 设置指标,所有WithSlave复制的客户端需要分别设置
+// 连接数量按连接记录,共用连接的客户端只记录一次,连接关闭后减少
+func (this *Client) SetMetrics(m Metrics) *Client {
+	this.metrics = m
+	if m != nil && this.conn != nil {
+		this.conn.watch(m)
+	}
+	return this
+}
+
+// connGauge 客户端连接数量,第一次设置指标时增加,连接关闭时减少
+type connGauge struct {
+	once sync.Once
+}
+
+func (this *connGauge) watch(m Metrics, closed <-chan struct{}) {
+	this.once.Do(func() {
+		m.Connection(SideClient, 1)
+		go func() {
+			<-closed
+			m.Connection(SideClient, -1)
+		}()
+	})
+}
+
+// observe 根据错误类型记录指标
+func observe(m Metrics, side string, err error) {
+	if m == nil || err == nil {
+		return
+	}
+	var code Control
+	var resp *ResponseError
+	switch {
+	case errors.As(err, &code):
+		m.Exception(side, code)
+	case errors.Is(err, ErrCRC):
+		m.CRCError(side)
+	case IsTimeout(err):
+		m.Timeout(side)
+	case errors.As(err, &resp):
+		m.FramingError(side)
+	}
+}
+
+// DefaultBuckets 默认耗时直方图的区间,单位秒
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// PromMetrics 内存中的指标,实现http.Handler,按Prometheus文本格式输出
+type PromMetrics struct {
+	mu         sync.Mutex
+	buckets    []float64
+	requests   map[string]uint64 //side,unit,fc
+	exceptions map[string]uint64 //side,code
+	counters   map[string]uint64 //name,side
+	conns      map[string]int64  //side
+	latency    map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewPromMetrics 新建指标,buckets为耗时直方图的区间(秒),为空时使用DefaultBuckets
+func NewPromMetrics(buckets ...float64) *PromMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &PromMetrics{
+		buckets:    buckets,
+		requests:   make(map[string]uint64),
+		exceptions: make(map[string]uint64),
+		counters:   make(map[string]uint64),
+		conns:      make(map[string]int64),
+		latency:    make(map[string]*histogram),
+	}
+}
+
+func (this *PromMetrics) Request(side string, slave byte, control Control, latency time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.requests[fmt.Sprintf(`side="%s",unit="%d",fc="%d"`, side, slave, byte(control))]++
+	key := fmt.Sprintf(`side="%s",fc="%d"`, side, byte(control))
+	h := this.latency[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(this.buckets))}
+		this.latency[key] = h
+	}
+	seconds := latency.Seconds()
+	for i, b := range this.buckets {
+		if seconds <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (this *PromMetrics) Exception(side string, code Control) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.exceptions[fmt.Sprintf(`side="%s",code="%d"`, side, byte(code)&0x7F)]++
+}
+
+func (this *PromMetrics) CRCError(side string)     { this.inc("modbus_crc_errors_total", side) }
+func (this *PromMetrics) FramingError(side string) { this.inc("modbus_framing_errors_total", side) }
+func (this *PromMetrics) Timeout(side string)      { this.inc("modbus_timeouts_total", side) }
+func (this *PromMetrics) Retry(side string)        { this.inc("modbus_retries_total", side) }
+
+func (this *PromMetrics) Connection(side string, delta int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.conns[side] += int64(delta)
+}
+
+func (this *PromMetrics) inc(name, side string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.counters[name+`{side="`+side+`"}`]++
+}
+
+// ServeHTTP 按Prometheus文本格式输出所有指标
+func (this *PromMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(this.String()))
+}
+
+// String Prometheus文本格式
+func (this *PromMetrics) String() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	b := &strings.Builder{}
+	write := func(name, typ, help string, values map[string]uint64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, k := range sortedKeys(values) {
+			fmt.Fprintf(b, "%s{%s} %d\n", name, k, values[k])
+		}
+	}
+	write("modbus_requests_total", "counter", "Modbus requests by function code and unit.", this.requests)
+	write("modbus_exceptions_total", "counter", "Modbus exception responses by code.", this.exceptions)
+	for _, c := range []struct{ name, help string }{
+		{"modbus_crc_errors_total", "Modbus frames discarded for CRC mismatch."},
+		{"modbus_framing_errors_total", "Modbus malformed frames or discarded bytes."},
+		{"modbus_timeouts_total", "Modbus requests without a response in time."},
+		{"modbus_retries_total", "Modbus requests retried."},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, k := range sortedKeys(this.counters) {
+			if strings.HasPrefix(k, c.name+"{") {
+				fmt.Fprintf(b, "%s %d\n", k, this.counters[k])
+			}
+		}
+	}
+	fmt.Fprintf(b, "# HELP modbus_active_connections Active connections.\n# TYPE modbus_active_connections gauge\n")
+	sides := make([]string, 0, len(this.conns))
+	for side := range this.conns {
+		sides = append(sides, side)
+	}
+	sort.Strings(sides)
+	for _, side := range sides {
+		fmt.Fprintf(b, "modbus_active_connections{side=\"%s\"} %d\n", side, this.conns[side])
+	}
+	fmt.Fprintf(b, "# HELP modbus_request_duration_seconds Modbus request latency.\n# TYPE modbus_request_duration_seconds histogram\n")
+	keys := make([]string, 0, len(this.latency))
+	for k := range this.latency {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := this.latency[k]
+		for i, bucket := range this.buckets {
+			fmt.Fprintf(b, "modbus_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", k, bucket, h.counts[i])
+		}
+		fmt.Fprintf(b, "modbus_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", k, h.count)
+		fmt.Fprintf(b, "modbus_request_duration_seconds_sum{%s} %g\n", k, h.sum)
+		fmt.Fprintf(b, "modbus_request_duration_seconds_count{%s} %d\n", k, h.count)
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
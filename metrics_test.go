@@ -0,0 +1,104 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewPromMetrics()
+	s := newTestServer().SetMetrics(m)
+	s.SetHoldingRegisters(200, ReadWriteRegister{
+		Read: func() ([2]byte, error) { return [2]byte{}, errors.New("设备故障") },
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listen)
+	defer s.Shutdown(context.Background())
+
+	c, err := DialTCP(listen.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(time.Second).SetMetrics(m)
+	c.ReadHoldingRegisters(1, 2)
+	c.ReadHoldingRegisters(200, 1)
+
+	//通过本地监听的HTTP获取指标
+	httpListen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpListen.Close()
+	go http.Serve(httpListen, m)
+	resp, err := http.Get("http://" + httpListen.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	text := string(body)
+	for _, want := range []string{
+		`modbus_requests_total{side="server",unit="1",fc="3"} 2`,
+		`modbus_requests_total{side="client",unit="1",fc="3"} 2`,
+		`modbus_exceptions_total{side="server",code="4"} 1`,
+		`modbus_active_connections{side="server"} 1`,
+		`modbus_active_connections{side="client"} 1`,
+		`# HELP modbus_crc_errors_total `,
+		`# HELP modbus_retries_total `,
+		`modbus_request_duration_seconds_count{side="client",fc="3"} 2`,
+		`modbus_request_duration_seconds_bucket{side="server",fc="3",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Error("缺少指标:", want)
+		}
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Error(resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestMetricsRTU(t *testing.T) {
+	m := NewPromMetrics()
+	s := newTestServer().SetMetrics(m)
+	conn, err := s.Pipe(RTU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewRTUClient(1, conn).SetMetrics(m)
+	//CRC错误的请求和杂散字节,从站丢弃后继续处理后面的请求
+	conn.Write([]byte{1, 3, 3, 3, 3, 3, 3, 3})
+	if _, err := c.SetTimeout(time.Second).ReadHoldingRegisters(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0xFF})
+	if _, err := c.ReadHoldingRegisters(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	text := m.String()
+	for _, want := range []string{
+		`modbus_crc_errors_total{side="server"} 1`,
+		`modbus_framing_errors_total{side="server"} 1`,
+		`modbus_active_connections{side="server"} 1`,
+		`modbus_active_connections{side="client"} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Error("缺少指标:", want)
+		}
+	}
+	c.Close()
+	time.Sleep(time.Millisecond * 50)
+	if text := m.String(); !strings.Contains(text, `modbus_active_connections{side="client"} 0`) ||
+		!strings.Contains(text, `modbus_active_connections{side="server"} 0`) {
+		t.Error("连接关闭后连接数量应减少", text)
+	}
+}
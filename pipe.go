@@ -0,0 +1,93 @@
+package modbus
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// PipeConfig 内存管道模拟的RTU线路
+type PipeConfig struct {
+	BaudRate  int     //波特率,按每个字符11位模拟传输耗时,0表示不模拟
+	NoiseRate float64 //线路干扰,每个位翻转的概率
+	Seed      int64   //干扰的随机数种子,相同的种子结果可以复现
+}
+
+// Pipe 通过内存管道连接从站,返回主站端的连接,不占用端口和串口,用于测试
+// cfg模拟线路的传输耗时和干扰,为nil时不模拟
+func (this *Server) Pipe(transport string, cfg *PipeConfig) (net.Conn, error) {
+	client, server := net.Pipe()
+	if cfg != nil {
+		line := &pipeLine{cfg: *cfg, rand: rand.New(rand.NewSource(cfg.Seed))}
+		client = &pipeConn{Conn: client, line: line}
+		server = &pipeConn{Conn: server, line: line}
+	}
+	switch transport {
+	case TCP:
+		if !this.trackConn(server) {
+			client.Close()
+			server.Close()
+			return nil, ErrServerClosed
+		}
+		go this.serveConn(server)
+	case RTU:
+		if err := this.trackRTU(server); err != nil {
+			client.Close()
+			server.Close()
+			return nil, err
+		}
+		go this.serveRTU(server, server.RemoteAddr().String())
+	default:
+		client.Close()
+		server.Close()
+		return nil, errors.New("未知Modbus类型:" + transport)
+	}
+	return client, nil
+}
+
+// PipeTCP 通过内存管道以TCP连接从站,用于测试
+func (this *Server) PipeTCP(slave byte) (*Client, error) {
+	conn, err := this.Pipe(TCP, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPClient(slave, conn), nil
+}
+
+// PipeRTU 通过内存管道以RTU连接从站,cfg为nil时不模拟线路,用于测试
+func (this *Server) PipeRTU(slave byte, cfg *PipeConfig) (*Client, error) {
+	conn, err := this.Pipe(RTU, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewRTUClient(slave, conn), nil
+}
+
+// pipeLine 模拟的RTU线路,两端共用
+type pipeLine struct {
+	cfg  PipeConfig
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// pipeConn 经过模拟线路的连接,写入时按波特率延时并加入干扰
+type pipeConn struct {
+	net.Conn
+	line *pipeLine
+}
+
+func (this *pipeConn) Write(p []byte) (int, error) {
+	cfg := this.line.cfg
+	if cfg.BaudRate > 0 {
+		time.Sleep(time.Duration(len(p)) * 11 * time.Second / time.Duration(cfg.BaudRate))
+	}
+	if cfg.NoiseRate > 0 {
+		p = CopyBytes(p)
+		this.line.mu.Lock()
+		flipBits(p, cfg.NoiseRate, this.line.rand)
+		this.line.mu.Unlock()
+	}
+	return this.Conn.Write(p)
+}
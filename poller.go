@@ -0,0 +1,319 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// QualityGood 正常
+	QualityGood Quality = iota
+
+	// QualityStale 过期,通讯失败,数据为上次读取的值
+	QualityStale
+
+	// QualityCommFail 通讯失败,连续失败次数达到上限或者从未读取成功
+	QualityCommFail
+
+	// QualityBad 读取成功,但是数据数量不足
+	QualityBad
+)
+
+// Quality 数据质量
+type Quality int
+
+func (this Quality) String() string {
+	switch this {
+	case QualityGood:
+		return "good"
+	case QualityStale:
+		return "stale"
+	case QualityBad:
+		return "bad"
+	default:
+		return "comm-fail"
+	}
+}
+
+// PollGroup 轮询点位组
+type PollGroup struct {
+	Name     string             //名称
+	Slave    byte               //从站地址
+	Key      string             //类型 KeyOutputCoils KeyInputCoils KeyInputRegisters KeyHoldingRegisters
+	Address  uint16             //起始地址
+	Quantity uint16             //数量
+	Interval time.Duration      //轮询间隔
+	OnValue  func(v *PollValue) //数据回调,可以为nil
+
+	last     *PollValue //上次读取成功的值
+	failures int        //连续失败次数
+}
+
+// PollValue 轮询结果
+type PollValue struct {
+	Group     *PollGroup
+	Registers []uint16  //寄存器的值,Key为3X或4X时有效
+	Coils     []bool    //线圈的值,Key为0X或1X时有效
+	Quality   Quality   //数据质量
+	Err       error     //通讯失败的错误
+	Time      time.Time //读取成功的时间
+}
+
+// Poller 周期轮询,相同从站,类型和间隔的相邻点位组合并成尽量少的请求
+type Poller struct {
+	client    func(slave byte) Interface
+	mu        sync.Mutex
+	groups    []*PollGroup
+	chans     []chan *PollValue
+	maxGap    uint16 //相隔不超过该数量的点位组也会合并
+	failLimit int    //连续失败次数达到该值后,质量为QualityCommFail
+}
+
+// NewPoller 新建轮询,按点位组的从站地址复制客户端,共用同一个连接
+func NewPoller(c *Client) *Poller {
+	return NewPollerWithFunc(func(slave byte) Interface { return c.WithSlave(slave) })
+}
+
+// NewPollerWithFunc 新建轮询,fn根据从站地址返回客户端
+func NewPollerWithFunc(fn func(slave byte) Interface) *Poller {
+	return &Poller{
+		client:    fn,
+		failLimit: 3,
+	}
+}
+
+// SetMaxGap 设置合并时允许的最大间隔,读取多余的点位换取更少的请求
+func (this *Poller) SetMaxGap(gap uint16) *Poller {
+	this.maxGap = gap
+	return this
+}
+
+// SetFailLimit 设置连续失败多少次后质量变为QualityCommFail
+func (this *Poller) SetFailLimit(n int) *Poller {
+	this.failLimit = n
+	return this
+}
+
+// Add 添加点位组,需要在Run之前添加
+func (this *Poller) Add(groups ...*PollGroup) error {
+	for _, g := range groups {
+		if g.Quantity == 0 {
+			return errors.New("点位组数量不能为0:" + g.Name)
+		}
+		if g.Interval <= 0 {
+			return errors.New("点位组轮询间隔错误:" + g.Name)
+		}
+		if limit := pollLimit(g.Key); limit == 0 {
+			return errors.New("未知点位类型:" + g.Key)
+		} else if int(g.Quantity) > limit {
+			return fmt.Errorf("点位组%s数量超出范围(1-%d):%d", g.Name, limit, g.Quantity)
+		}
+		if int(g.Address)+int(g.Quantity) > 65536 {
+			return errors.New("点位组超出地址范围:" + g.Name)
+		}
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.groups = append(this.groups, groups...)
+	return nil
+}
+
+// Chan 新建一个接收所有轮询结果的通道,通道满时丢弃结果,保证轮询周期稳定
+func (this *Poller) Chan(size int) <-chan *PollValue {
+	c := make(chan *PollValue, size)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.chans = append(this.chans, c)
+	return c
+}
+
+// Run 开始轮询,阻塞直到ctx关闭
+func (this *Poller) Run(ctx context.Context) error {
+	this.mu.Lock()
+	intervals := map[time.Duration][]*pollRequest{}
+	for _, r := range this.plan() {
+		intervals[r.interval] = append(intervals[r.interval], r)
+	}
+	this.mu.Unlock()
+	if len(intervals) == 0 {
+		return errors.New("未添加点位组")
+	}
+	wg := sync.WaitGroup{}
+	for interval, list := range intervals {
+		wg.Add(1)
+		go func(interval time.Duration, list []*pollRequest) {
+			defer wg.Done()
+			this.run(ctx, interval, list)
+		}(interval, list)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// run 按固定周期执行请求,执行时间超过周期时跳过错过的周期
+func (this *Poller) run(ctx context.Context, interval time.Duration, list []*pollRequest) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, r := range list {
+			cctx, cancel := context.WithTimeout(ctx, interval)
+			this.poll(cctx, r)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll 执行一个请求,并把结果分发给包含的点位组
+func (this *Poller) poll(ctx context.Context, r *pollRequest) {
+	c := this.client(r.slave)
+	var registers []uint16
+	var coils []bool
+	var err error
+	switch r.key {
+	case KeyOutputCoils:
+		coils, err = c.ReadOutputCoilsContext(ctx, r.address, r.quantity)
+	case KeyInputCoils:
+		coils, err = c.ReadInputCoilsContext(ctx, r.address, r.quantity)
+	case KeyInputRegisters:
+		registers, err = c.ReadInputRegistersContext(ctx, r.address, r.quantity)
+	case KeyHoldingRegisters:
+		registers, err = c.ReadHoldingRegistersContext(ctx, r.address, r.quantity)
+	}
+	now := time.Now()
+	for _, g := range r.groups {
+		if err != nil {
+			this.publish(this.fail(g, err))
+			continue
+		}
+		v := &PollValue{Group: g, Quality: QualityGood, Time: now}
+		offset := int(g.Address - r.address)
+		end := offset + int(g.Quantity)
+		switch {
+		case r.key == KeyInputRegisters || r.key == KeyHoldingRegisters:
+			if len(registers) < end {
+				this.publish(&PollValue{Group: g, Quality: QualityBad, Err: ErrMismatchLength, Time: now})
+				continue
+			}
+			v.Registers = registers[offset:end]
+		default:
+			if len(coils) < end {
+				this.publish(&PollValue{Group: g, Quality: QualityBad, Err: ErrMismatchLength, Time: now})
+				continue
+			}
+			v.Coils = coils[offset:end]
+		}
+		this.mu.Lock()
+		g.last, g.failures = v, 0
+		this.mu.Unlock()
+		this.publish(v)
+	}
+}
+
+// fail 通讯失败,返回上次的值,连续失败达到上限后质量为QualityCommFail
+func (this *Poller) fail(g *PollGroup, err error) *PollValue {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g.failures++
+	v := &PollValue{Group: g, Quality: QualityCommFail, Err: err}
+	if g.last != nil && g.failures < this.failLimit {
+		v.Registers, v.Coils, v.Time = g.last.Registers, g.last.Coils, g.last.Time
+		v.Quality = QualityStale
+	}
+	return v
+}
+
+func (this *Poller) publish(v *PollValue) {
+	if v.Group.OnValue != nil {
+		v.Group.OnValue(v)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, c := range this.chans {
+		select {
+		case c <- v:
+		default:
+		}
+	}
+}
+
+// pollRequest 合并后的一个请求
+type pollRequest struct {
+	slave    byte
+	key      string
+	interval time.Duration
+	address  uint16
+	quantity uint16
+	groups   []*PollGroup
+}
+
+// plan 合并点位组,相同从站,类型和间隔的点位组,按地址排序后合并相邻(或重叠)的
+// 合并后不超过功能码的数量限制
+func (this *Poller) plan() []*pollRequest {
+	type key struct {
+		slave    byte
+		key      string
+		interval time.Duration
+	}
+	m := map[key][]*PollGroup{}
+	keys := []key(nil)
+	for _, g := range this.groups {
+		k := key{g.Slave, g.Key, g.Interval}
+		if _, ok := m[k]; !ok {
+			keys = append(keys, k)
+		}
+		m[k] = append(m[k], g)
+	}
+
+	result := []*pollRequest(nil)
+	for _, k := range keys {
+		groups := m[k]
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].Address < groups[j].Address })
+		limit := pollLimit(k.key)
+		var r *pollRequest
+		for _, g := range groups {
+			start, end := int(g.Address), int(g.Address)+int(g.Quantity)
+			if r != nil {
+				rEnd := int(r.address) + int(r.quantity)
+				newEnd := rEnd
+				if end > newEnd {
+					newEnd = end
+				}
+				if start <= rEnd+int(this.maxGap) && newEnd-int(r.address) <= limit {
+					r.quantity = uint16(newEnd - int(r.address))
+					r.groups = append(r.groups, g)
+					continue
+				}
+			}
+			r = &pollRequest{
+				slave: k.slave, key: k.key, interval: k.interval,
+				address: g.Address, quantity: g.Quantity,
+				groups: []*PollGroup{g},
+			}
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// pollLimit 功能码一次最多读取的数量
+func pollLimit(key string) int {
+	switch key {
+	case KeyOutputCoils, KeyInputCoils:
+		return 2000
+	case KeyInputRegisters, KeyHoldingRegisters:
+		return 125
+	}
+	return 0
+}
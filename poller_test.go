@@ -0,0 +1,72 @@
+package modbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoller(t *testing.T) {
+	s := newTestServer()
+	s.SetCoils(9, ReadWriteCoils{Read: func() (bool, error) { return true, nil }})
+
+	p := NewPoller(pipeTCP(s, 1))
+	a := &PollGroup{Name: "a", Key: KeyHoldingRegisters, Address: 10, Quantity: 5, Interval: time.Millisecond * 20}
+	b := &PollGroup{Name: "b", Key: KeyHoldingRegisters, Address: 15, Quantity: 5, Interval: time.Millisecond * 20}
+	c := &PollGroup{Name: "c", Key: KeyOutputCoils, Address: 8, Quantity: 3, Interval: time.Millisecond * 20}
+	if err := p.Add(a, b, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.plan()) != 2 {
+		t.Fatal("相邻的点位组应该合并成一个请求")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	values := p.Chan(10)
+	go p.Run(ctx)
+	got := map[string]*PollValue{}
+	for len(got) < 3 {
+		v := <-values
+		got[v.Group.Name] = v
+	}
+	cancel()
+
+	if v := got["b"]; v.Quality != QualityGood || v.Registers[0] != 15 || v.Registers[4] != 19 {
+		t.Error("点位组b数据错误", v.Quality, v.Registers, v.Err)
+	}
+	if v := got["c"]; v.Quality != QualityGood || v.Coils[0] || !v.Coils[1] || v.Coils[2] {
+		t.Error("点位组c数据错误", v.Quality, v.Coils, v.Err)
+	}
+}
+
+func TestPollerFail(t *testing.T) {
+	p := NewPollerWithFunc(nil).SetFailLimit(2)
+	g := &PollGroup{Key: KeyHoldingRegisters, Address: 1, Quantity: 1, Interval: time.Millisecond}
+	g.last = &PollValue{Registers: []uint16{1}}
+	if v := p.fail(g, DeviceBusy); v.Quality != QualityStale || v.Registers[0] != 1 {
+		t.Error("第一次失败应该是过期数据", v.Quality)
+	}
+	if v := p.fail(g, DeviceBusy); v.Quality != QualityCommFail || v.Registers != nil {
+		t.Error("连续失败应该是通讯失败", v.Quality)
+	}
+}
+
+// shortClient 读取寄存器返回的数量不足
+type shortClient struct{ Interface }
+
+func (shortClient) ReadHoldingRegistersContext(ctx context.Context, address, quantity uint16) ([]uint16, error) {
+	return nil, nil
+}
+
+func TestPollerShort(t *testing.T) {
+	p := NewPollerWithFunc(func(slave byte) Interface { return shortClient{} })
+	g := &PollGroup{Key: KeyHoldingRegisters, Address: 1, Quantity: 2, Interval: time.Millisecond}
+	if err := p.Add(g); err != nil {
+		t.Fatal(err)
+	}
+	values := p.Chan(1)
+	p.poll(context.Background(), p.plan()[0])
+	if v := <-values; v.Quality != QualityBad || v.Err != ErrMismatchLength || v.Coils != nil {
+		t.Error("数据数量不足应该是坏数据", v.Quality, v.Err)
+	}
+}
@@ -3,15 +3,20 @@ package modbus
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/goburrow/serial"
 	"io"
-	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 type RTUOption = serial.Config
 
+// ErrServerClosed 从站已关闭
+var ErrServerClosed = errors.New("从站已关闭")
+
 type Server struct {
 	Coils            Coils                //线圈 0x01(0x读),0x05(写1个),0x0f(写多个)
 	DiscreteInputs   Coils                //离散输入(只读的线圈) 0x02(1x读)
@@ -19,36 +24,76 @@ type Server struct {
 	HoldingRegisters Register             //保持寄存器 0x03(4x读) 0x06(写1个) 0x10(写多个)
 	Handler          [43]Handler          //处理函数,下标对应功能码
 	listenTCP        []net.Listener       //监听tcp
-	ctxTCP           context.Context      //TCP上下文
-	cancelTCP        context.CancelFunc   //TCP上下文关闭
 	listenRTU        []io.ReadWriteCloser //监听rtu
-	ctxRTU           context.Context      //RTU上下文
-	cancelRTU        context.CancelFunc   //RTU上下文关闭
 	ctx              context.Context      //上下文
 	debug            bool                 //打印日志
 	printHandler     func(Frame, Frame)   //打印日志函数
+
+	registerConstraints []Constraint                    //保持寄存器写入约束
+	coilConstraints     []Constraint                    //线圈写入约束
+	writeHook           func(*WriteBlock) error         //写入钩子
+	transaction         bool                            //事务模式
+	batchWriter         BatchWriter                     //批量写入
+	mu                  sync.RWMutex                    //读写锁
+	memory              *Memory                         //存储,设置后读写都使用存储
+	writeSubs           writeSubs                       //写入事件订阅
+	accessRules         []*AccessRule                   //访问规则
+	accessDefault       Access                          //没有匹配规则时的权限
+	accessCode          Control                         //拒绝时响应的异常码
+	accessHook          func(*AccessDecision)           //访问控制日志
+	aclMu               sync.RWMutex                    //访问控制的锁
+	conns               map[net.Conn]*ConnInfo          //TCP连接
+	maxConns            int                             //TCP连接总数上限
+	maxConnsPerIP       int                             //每个IP的TCP连接数上限
+	dropPolicy          DropPolicy                      //连接数量达到上限时的处理方式
+	readTimeout         time.Duration                   //读取超时
+	idleTimeout         time.Duration                   //空闲超时
+	lifeMu              sync.Mutex                      //监听和连接的锁
+	wg                  sync.WaitGroup                  //监听和连接的协程
+	shutdown            bool                            //已关闭,不能再监听
+	closed              chan struct{}                   //关闭时关闭,lifeMu保护
+	stopped             bool                            //closed已关闭
+	logger              Logger                          //日志
+	trace               func(Frame, func() error) error //追踪钩子
+	metrics             Metrics                         //指标
+	captureWriter       Capture                         //抓包
+	faults              faults                          //注入的故障
 }
 
 // SetCoils 设置线圈接口
 func (this *Server) SetCoils(register uint16, wrc ReadWriteCoils) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 	this.Coils[register] = wrc
 }
 
 // SetDiscreteInputs 设置离散输入接口
 func (this *Server) SetDiscreteInputs(register uint16, wrc ReadWriteCoils) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 	this.DiscreteInputs[register] = wrc
 }
 
 // SetInputRegisters 设置数据寄存器接口
 func (this *Server) SetInputRegisters(register uint16, wrc ReadWriteRegister) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 	this.InputRegisters[register] = wrc
 }
 
 // SetHoldingRegisters 设置保持寄存器接口
 func (this *Server) SetHoldingRegisters(register uint16, wrc ReadWriteRegister) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 	this.HoldingRegisters[register] = wrc
 }
 
+// SetMemory 设置存储,设置后读写线圈和寄存器都使用存储,不再使用Coils等接口
+func (this *Server) SetMemory(m *Memory) *Server {
+	this.memory = m
+	return this
+}
+
 // SetHandler 设置功能码对应函数
 func (this *Server) SetHandler(code int, handler Handler) {
 	if code > 0 && code < len(this.Handler) {
@@ -62,126 +107,387 @@ func (this *Server) SetPrintHandler(fn func(origin, result Frame)) *Server {
 	return this
 }
 
-// Debug 调试模式
+// Debug 调试模式,未设置日志时使用标准库log输出所有等级的日志
 func (this *Server) Debug(b ...bool) {
 	this.debug = !(len(b) > 0 && !b[0])
 }
 
 // ListenTCPNum 监听TCP端口的服务数量
 func (this *Server) ListenTCPNum() int {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
 	return len(this.listenTCP)
 }
 
 // ListenRTUNum 监听RTU服务的数量
 func (this *Server) ListenRTUNum() int {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
 	return len(this.listenRTU)
 }
 
-// Close 关闭所有
+// Addr 第一个TCP监听的地址,未监听时返回nil
+func (this *Server) Addr() net.Addr {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	if len(this.listenTCP) == 0 {
+		return nil
+	}
+	return this.listenTCP[0].Addr()
+}
+
+// Close 关闭所有监听和连接,不等待处理中的请求,关闭后可以重新监听
 func (this *Server) Close() error {
-	this.CloseRTU()
-	this.CloseTCP()
-	return nil
+	err := this.CloseRTU()
+	if err2 := this.CloseTCP(); err == nil {
+		err = err2
+	}
+	return err
 }
 
 // CloseRTU 关闭所有RTU连接
-func (this *Server) CloseRTU() {
-	if this.cancelRTU != nil {
-		this.cancelRTU()
-		this.cancelRTU = nil
+func (this *Server) CloseRTU() error {
+	this.lifeMu.Lock()
+	list := make([]io.Closer, 0, len(this.listenRTU))
+	for _, c := range this.listenRTU {
+		list = append(list, c)
 	}
 	this.listenRTU = []io.ReadWriteCloser(nil)
+	this.lifeMu.Unlock()
+	return closeAll(list...)
 }
 
-// CloseTCP 关闭所有TCP连接
-func (this *Server) CloseTCP() {
-	if this.cancelTCP != nil {
-		this.cancelTCP()
-		this.cancelTCP = nil
+// CloseTCP 关闭所有TCP监听和已建立的连接
+func (this *Server) CloseTCP() error {
+	this.lifeMu.Lock()
+	list := make([]io.Closer, 0, len(this.listenTCP)+len(this.conns))
+	for _, l := range this.listenTCP {
+		list = append(list, l)
+	}
+	for c := range this.conns {
+		list = append(list, c)
 	}
 	this.listenTCP = []net.Listener(nil)
+	this.conns = nil
+	this.lifeMu.Unlock()
+	return closeAll(list...)
 }
 
-// ListenTCP 监听TCP端口
-func (this *Server) ListenTCP(port int) error {
-	if this.cancelTCP == nil {
-		this.ctxTCP, this.cancelTCP = context.WithCancel(this.ctx)
+// Shutdown 关闭所有监听和连接,并等待处理中的请求结束,ctx结束时返回ctx的错误
+// 关闭后不能再监听,Serve返回ErrServerClosed
+func (this *Server) Shutdown(ctx context.Context) error {
+	this.lifeMu.Lock()
+	this.shutdown = true
+	this.lifeMu.Unlock()
+	err := this.Close()
+	//关闭连接后再结束等待中的请求(例故障延时),避免重复关闭连接
+	this.lifeMu.Lock()
+	if !this.stopped {
+		this.stopped = true
+		if this.closed != nil {
+			close(this.closed)
+		}
 	}
+	this.lifeMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		this.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return err
+	}
+}
+
+// closing 从站关闭(Shutdown)时关闭的通道
+func (this *Server) closing() <-chan struct{} {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	if this.closed == nil {
+		this.closed = make(chan struct{})
+		if this.stopped {
+			close(this.closed)
+		}
+	}
+	return this.closed
+}
+
+// ListenTCP 监听TCP端口,在后台处理连接
+func (this *Server) ListenTCP(port int) error {
 	listen, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return err
 	}
+	if err := this.track(listen); err != nil {
+		listen.Close()
+		return err
+	}
+	go func() {
+		if err := this.serve(listen); err != ErrServerClosed {
+			this.log(LevelError, EventError, Field{FieldError, err})
+		}
+	}()
+	return nil
+}
+
+// ListenAndServe 监听TCP地址(例 "127.0.0.1:502"),阻塞直到关闭或出错
+func (this *Server) ListenAndServe(addr string) error {
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return this.Serve(listen)
+}
+
+// Serve 在监听上接收TCP连接,阻塞直到关闭或出错,关闭时返回ErrServerClosed
+func (this *Server) Serve(listen net.Listener) error {
+	if err := this.track(listen); err != nil {
+		listen.Close()
+		return err
+	}
+	return this.serve(listen)
+}
+
+// track 记录监听,已关闭时返回ErrServerClosed
+func (this *Server) track(listen net.Listener) error {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	if this.shutdown {
+		return ErrServerClosed
+	}
 	this.listenTCP = append(this.listenTCP, listen)
-	go func(ctx context.Context, listen net.Listener) {
-		defer listen.Close()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				conn, err := listen.Accept()
-				if err != nil {
-					this.printErr(err)
-					return
-				}
-				go func(ctx context.Context, conn net.Conn) {
-					defer conn.Close()
-					for {
-						select {
-						case <-ctx.Done():
-							return
-						default:
-							//按TCP格式读取数据
-							frame, err := ReadWithTCP(conn)
-							if err != nil {
-								this.printErr(err)
-								return
-							}
-							this.printErr(this.handle(frame, conn))
-						}
+	this.wg.Add(1)
+	return nil
+}
+
+// serve 接收连接,监听被关闭时返回ErrServerClosed
+func (this *Server) serve(listen net.Listener) error {
+	defer this.wg.Done()
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			if !this.listening(listen) {
+				return ErrServerClosed
+			}
+			this.untrack(listen)
+			listen.Close()
+			return err
+		}
+		if !this.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+		go this.serveConn(conn)
+	}
+}
+
+// serveConn 按TCP格式读取请求并处理,连接关闭,超时或出错时结束
+func (this *Server) serveConn(conn net.Conn) {
+	defer this.wg.Done()
+	defer this.untrackConn(conn)
+	defer conn.Close()
+	peer := conn.RemoteAddr().String()
+	if this.metrics != nil {
+		this.metrics.Connection(SideServer, 1)
+		defer this.metrics.Connection(SideServer, -1)
+	}
+	this.log(LevelInfo, EventConnect, Field{FieldPeer, peer}, Field{FieldTransport, TCP})
+	reader := &deadlineReader{conn: conn, idle: this.idleTimeout, read: this.readTimeout}
+	for {
+		//按TCP格式读取数据
+		reader.reset()
+		frame, err := ReadWithTCP(reader)
+		if err != nil {
+			fields := []Field{{FieldPeer, peer}, {FieldTransport, TCP}}
+			if err != io.EOF && this.connected(conn) {
+				this.record(conn, 0, true)
+				fields = append(fields, Field{FieldError, err})
+				if _, ok := err.(net.Error); !ok && err != io.ErrUnexpectedEOF {
+					this.log(LevelWarn, EventFramingError, fields...)
+					if this.metrics != nil {
+						this.metrics.FramingError(SideServer)
 					}
-				}(ctx, conn)
+				}
 			}
+			this.log(LevelInfo, EventDisconnect, fields...)
+			return
 		}
-	}(this.ctxTCP, listen)
-	return nil
+		control := frame.GetControl()
+		if err := this.serveRequest(&Request{
+			Frame:     frame,
+			Peer:      peer,
+			Transport: TCP,
+		}, conn); err != nil {
+			this.log(LevelInfo, EventDisconnect, Field{FieldPeer, peer}, Field{FieldTransport, TCP}, Field{FieldError, err})
+			return
+		}
+		this.record(conn, control, frame.GetControl() != control)
+	}
 }
 
-// ListenRTU 监听RTU
-func (this *Server) ListenRTU(cfg *serial.Config) error {
-	if this.cancelRTU == nil {
-		this.ctxRTU, this.cancelRTU = context.WithCancel(this.ctx)
+func (this *Server) listening(listen net.Listener) bool {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	for _, l := range this.listenTCP {
+		if l == listen {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Server) untrack(listen net.Listener) {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	for i, l := range this.listenTCP {
+		if l == listen {
+			this.listenTCP = append(this.listenTCP[:i], this.listenTCP[i+1:]...)
+			return
+		}
+	}
+}
+
+// trackConn 记录连接,已关闭或连接数量达到上限时返回false
+func (this *Server) trackConn(conn net.Conn) bool {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	if this.shutdown || !this.admit(conn) {
+		return false
+	}
+	if this.conns == nil {
+		this.conns = make(map[net.Conn]*ConnInfo)
 	}
+	now := time.Now()
+	this.conns[conn] = &ConnInfo{
+		Addr:        conn.RemoteAddr().String(),
+		ConnectTime: now,
+		LastActive:  now,
+	}
+	this.wg.Add(1)
+	return true
+}
+
+func (this *Server) connected(conn net.Conn) bool {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	return this.conns[conn] != nil
+}
+
+func (this *Server) untrackConn(conn net.Conn) {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	delete(this.conns, conn)
+}
+
+// ListenRTU 监听RTU,在后台处理请求
+func (this *Server) ListenRTU(cfg *serial.Config) error {
 	client, err := serial.Open(cfg)
 	if err != nil {
 		return err
 	}
-	this.listenRTU = append(this.listenRTU, client)
-	go func(ctx context.Context, conn serial.Port) {
-		defer conn.Close()
-		buf := bufio.NewReader(conn)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				//按RTU读取数据
-				frame, err := ReadWithRTU(buf)
-				if err != nil {
-					this.printErr(err)
-					continue
+	if err := this.trackRTU(client); err != nil {
+		client.Close()
+		return err
+	}
+	go this.serveRTU(client, cfg.Address)
+	return nil
+}
+
+// trackRTU 记录RTU连接,已关闭时返回ErrServerClosed
+func (this *Server) trackRTU(conn io.ReadWriteCloser) error {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	if this.shutdown {
+		return ErrServerClosed
+	}
+	this.listenRTU = append(this.listenRTU, conn)
+	this.wg.Add(1)
+	return nil
+}
+
+// serveRTU 处理RTU请求,直到连接被关闭
+func (this *Server) serveRTU(conn io.ReadWriteCloser, peer string) {
+	defer this.wg.Done()
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	if this.metrics != nil {
+		this.metrics.Connection(SideServer, 1)
+		defer this.metrics.Connection(SideServer, -1)
+	}
+	for {
+		//按RTU读取数据
+		frame, dropped, crc, err := readRTU(buf)
+		if dropped > 0 {
+			//重新同步丢弃了数据,第一段数据是完整的请求时按CRC错误记录
+			dropErr := fmt.Errorf("数据帧格式错误,丢弃%d字节", dropped)
+			if crc {
+				dropErr = fmt.Errorf("%w,丢弃%d字节", ErrCRC, dropped)
+			}
+			this.log(LevelWarn, EventFramingError, Field{FieldPeer, peer}, Field{FieldTransport, RTU}, Field{FieldError, dropErr})
+			if this.metrics != nil {
+				if crc {
+					this.metrics.CRCError(SideServer)
+				} else {
+					this.metrics.FramingError(SideServer)
 				}
-				this.printErr(this.handle(frame, conn))
 			}
 		}
-	}(this.ctxRTU, client)
-	return nil
+		if err != nil {
+			if !this.listeningRTU(conn) {
+				return
+			}
+			if err == io.EOF || err == io.ErrClosedPipe {
+				//对端关闭了连接
+				this.untrackRTU(conn)
+				return
+			}
+			this.log(LevelWarn, EventError, Field{FieldPeer, peer}, Field{FieldTransport, RTU}, Field{FieldError, err})
+			continue
+		}
+		if err := this.serveRequest(&Request{
+			Frame:     frame,
+			Peer:      peer,
+			Transport: RTU,
+		}, conn); err != nil {
+			this.log(LevelError, EventError, Field{FieldPeer, peer}, Field{FieldTransport, RTU}, Field{FieldError, err})
+		}
+	}
+}
+
+func (this *Server) untrackRTU(conn io.ReadWriteCloser) {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	for i, c := range this.listenRTU {
+		if c == conn {
+			this.listenRTU = append(this.listenRTU[:i], this.listenRTU[i+1:]...)
+			return
+		}
+	}
 }
 
-func (this *Server) printErr(err error) {
-	if this.debug && err != nil {
-		log.Println("[错误]", err)
+func (this *Server) listeningRTU(conn io.ReadWriteCloser) bool {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	for _, c := range this.listenRTU {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// closeAll 关闭全部,返回第一个错误
+func closeAll(list ...io.Closer) error {
+	var err error
+	for _, c := range list {
+		if e := c.Close(); err == nil {
+			err = e
+		}
 	}
+	return err
 }
 
 func NewServer() *Server {
@@ -191,7 +497,6 @@ func NewServer() *Server {
 func NewServerWithContext(ctx context.Context) *Server {
 	s := &Server{}
 	s.ctx = ctx
-	s.SetPrintHandler(s.defaultPrintHandler)
 	s.SetHandler(1, s.handler1)
 	s.SetHandler(2, s.handler2)
 	s.SetHandler(3, s.handler3)
@@ -200,5 +505,12 @@ func NewServerWithContext(ctx context.Context) *Server {
 	s.SetHandler(6, s.handler6)
 	s.SetHandler(15, s.handler15)
 	s.SetHandler(16, s.handler16)
+	if ctx.Done() != nil {
+		//上下文结束时关闭所有监听和连接
+		go func() {
+			<-ctx.Done()
+			s.Close()
+		}()
+	}
 	return s
 }
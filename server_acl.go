@@ -0,0 +1,203 @@
+package modbus
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Access 访问权限
+type Access int
+
+const (
+	AccessAllow    Access = iota //允许
+	AccessDeny                   //拒绝
+	AccessReadOnly               //只允许读,拒绝写
+)
+
+func (this Access) String() string {
+	switch this {
+	case AccessAllow:
+		return "allow"
+	case AccessDeny:
+		return "deny"
+	case AccessReadOnly:
+		return "read-only"
+	}
+	return "unknown"
+}
+
+// AccessRule 访问规则,所有条件都满足时匹配,条件为空时不限制,按添加顺序匹配第一个规则
+type AccessRule struct {
+	CIDR     string    //来源IP或网段,例 "192.168.1.0/24" "10.0.0.1",RTU的来源不是IP,设置后不匹配
+	Slaves   []byte    //从站地址
+	Controls []Control //功能码
+	Start    uint16    //起始地址
+	Quantity uint16    //数量,0表示不限制地址,请求的地址范围有重叠时匹配
+	Access   Access    //权限
+	Code     Control   //拒绝时响应的异常码,0使用默认异常码
+	network  *net.IPNet
+}
+
+// AccessDecision 访问控制的结果
+type AccessDecision struct {
+	Peer      string      //来源
+	Transport string      //传输方式
+	Slave     byte        //从站地址
+	Control   Control     //功能码
+	Address   uint16      //起始地址
+	Quantity  uint16      //数量
+	Rule      *AccessRule //匹配的规则,nil表示使用默认权限
+	Access    Access      //权限
+	Allowed   bool        //是否允许
+	Code      Control     //拒绝时响应的异常码
+}
+
+// AddAccessRule 添加访问规则,在处理函数之前校验
+func (this *Server) AddAccessRule(rules ...AccessRule) error {
+	for i := range rules {
+		if cidr := rules[i].CIDR; cidr != "" {
+			if !strings.Contains(cidr, "/") {
+				if strings.Contains(cidr, ":") {
+					cidr += "/128"
+				} else {
+					cidr += "/32"
+				}
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return errors.New("访问规则网段错误:" + rules[i].CIDR)
+			}
+			rules[i].network = network
+		}
+	}
+	this.aclMu.Lock()
+	defer this.aclMu.Unlock()
+	for i := range rules {
+		this.accessRules = append(this.accessRules, &rules[i])
+	}
+	return nil
+}
+
+// SetAccessDefault 设置没有匹配规则时的权限,默认允许,设置为AccessDeny时为白名单模式
+func (this *Server) SetAccessDefault(a Access) *Server {
+	this.aclMu.Lock()
+	defer this.aclMu.Unlock()
+	this.accessDefault = a
+	return this
+}
+
+// SetAccessDenyCode 设置拒绝时默认响应的异常码,默认IllegalFunction,可选IllegalAddress
+func (this *Server) SetAccessDenyCode(code Control) *Server {
+	this.aclMu.Lock()
+	defer this.aclMu.Unlock()
+	this.accessCode = code
+	return this
+}
+
+// SetAccessHook 设置访问控制日志,每个请求的结果都会回调
+func (this *Server) SetAccessHook(fn func(d *AccessDecision)) *Server {
+	this.aclMu.Lock()
+	defer this.aclMu.Unlock()
+	this.accessHook = fn
+	return this
+}
+
+// access 校验访问权限,允许时返回Success,否则返回异常码
+func (this *Server) access(f Frame) Control {
+	this.aclMu.RLock()
+	rules, def, code, hook := this.accessRules, this.accessDefault, this.accessCode, this.accessHook
+	this.aclMu.RUnlock()
+	if len(rules) == 0 && def == AccessAllow && hook == nil {
+		return Success
+	}
+
+	d := &AccessDecision{Slave: f.GetSlave(), Control: f.GetControl(), Access: def}
+	if r, ok := f.(*Request); ok {
+		d.Peer, d.Transport = r.Peer, r.Transport
+	}
+	data := f.GetData()
+	ranged := len(data) >= 4
+	if ranged {
+		d.Address = uint16(data[0])<<8 | uint16(data[1])
+		d.Quantity = uint16(data[2])<<8 | uint16(data[3])
+		switch d.Control {
+		case WriteCoils, WriteRegisters, MaskWriteRegisters:
+			d.Quantity = 1
+		}
+	}
+	ip := net.ParseIP(hostOf(d.Peer))
+	for _, rule := range rules {
+		if rule.match(d, ip, ranged) {
+			d.Rule, d.Access = rule, rule.Access
+			if rule.Code != 0 {
+				code = rule.Code
+			}
+			break
+		}
+	}
+
+	switch d.Access {
+	case AccessAllow:
+		d.Allowed = true
+	case AccessReadOnly:
+		switch d.Control {
+		case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters:
+			d.Allowed = true
+		}
+	}
+	if !d.Allowed {
+		d.Code = code
+		if d.Code == 0 {
+			d.Code = IllegalFunction
+		}
+	}
+	if hook != nil {
+		hook(d)
+	}
+	if d.Allowed {
+		return Success
+	}
+	return d.Code
+}
+
+// match 请求是否匹配规则
+func (this *AccessRule) match(d *AccessDecision, ip net.IP, ranged bool) bool {
+	if this.network != nil && (ip == nil || !this.network.Contains(ip)) {
+		return false
+	}
+	if len(this.Slaves) > 0 && !containsByte(this.Slaves, d.Slave) {
+		return false
+	}
+	if len(this.Controls) > 0 {
+		found := false
+		for _, c := range this.Controls {
+			if c == d.Control {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if this.Quantity > 0 {
+		if !ranged {
+			return false
+		}
+		end := int(this.Start) + int(this.Quantity)
+		if int(d.Address)+int(d.Quantity) <= int(this.Start) || int(d.Address) >= end {
+			return false
+		}
+	}
+	return true
+}
+
+func containsByte(list []byte, b byte) bool {
+	for _, v := range list {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package modbus
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// DropPolicy 连接数量达到上限时的处理方式
+type DropPolicy int
+
+const (
+	DropNew    DropPolicy = iota //拒绝新连接,默认
+	DropOldest                   //关闭最早建立的连接
+	DropIdle                     //关闭空闲最久的连接
+)
+
+// ConnInfo TCP连接信息
+type ConnInfo struct {
+	Addr        string    //远程地址
+	ConnectTime time.Time //建立连接的时间
+	LastActive  time.Time //最后收到请求的时间
+	Requests    uint64    //请求数量
+	Errors      uint64    //异常响应和读取错误的数量
+	LastControl Control   //最后一次请求的功能码
+}
+
+// SetMaxConns 设置TCP连接总数上限,0表示不限制
+func (this *Server) SetMaxConns(n int) *Server {
+	this.maxConns = n
+	return this
+}
+
+// SetMaxConnsPerIP 设置每个IP的TCP连接数上限,0表示不限制
+func (this *Server) SetMaxConnsPerIP(n int) *Server {
+	this.maxConnsPerIP = n
+	return this
+}
+
+// SetDropPolicy 设置连接数量达到上限时的处理方式
+func (this *Server) SetDropPolicy(p DropPolicy) *Server {
+	this.dropPolicy = p
+	return this
+}
+
+// SetReadTimeout 设置读取超时,收到请求的第一个字节后,需在该时间内收完整个请求,0表示不限制
+func (this *Server) SetReadTimeout(d time.Duration) *Server {
+	this.readTimeout = d
+	return this
+}
+
+// SetIdleTimeout 设置空闲超时,超过该时间没有收到请求时关闭连接,0表示不限制
+func (this *Server) SetIdleTimeout(d time.Duration) *Server {
+	this.idleTimeout = d
+	return this
+}
+
+// Connections 当前所有TCP连接的信息,按建立连接的时间排序
+func (this *Server) Connections() []ConnInfo {
+	this.lifeMu.Lock()
+	result := make([]ConnInfo, 0, len(this.conns))
+	for _, info := range this.conns {
+		result = append(result, *info)
+	}
+	this.lifeMu.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ConnectTime.Before(result[j].ConnectTime)
+	})
+	return result
+}
+
+// admit 判断是否允许新连接,按策略关闭旧连接,需要持有lifeMu
+func (this *Server) admit(conn net.Conn) bool {
+	ip := hostOf(conn.RemoteAddr().String())
+	for {
+		total, perIP := len(this.conns), 0
+		for c := range this.conns {
+			if hostOf(c.RemoteAddr().String()) == ip {
+				perIP++
+			}
+		}
+		sameIP := this.maxConnsPerIP > 0 && perIP >= this.maxConnsPerIP
+		if !sameIP && (this.maxConns <= 0 || total < this.maxConns) {
+			return true
+		}
+		if this.dropPolicy == DropNew {
+			return false
+		}
+		var victim net.Conn
+		for c, info := range this.conns {
+			if sameIP && hostOf(c.RemoteAddr().String()) != ip {
+				continue
+			}
+			if victim == nil {
+				victim = c
+				continue
+			}
+			old := this.conns[victim]
+			switch this.dropPolicy {
+			case DropOldest:
+				if info.ConnectTime.Before(old.ConnectTime) {
+					victim = c
+				}
+			case DropIdle:
+				if info.LastActive.Before(old.LastActive) {
+					victim = c
+				}
+			}
+		}
+		if victim == nil {
+			return false
+		}
+		delete(this.conns, victim)
+		victim.Close()
+	}
+}
+
+// record 记录连接的请求,出错时错误数量加1
+func (this *Server) record(conn net.Conn, control Control, failed bool) {
+	this.lifeMu.Lock()
+	defer this.lifeMu.Unlock()
+	if info := this.conns[conn]; info != nil {
+		if control != 0 {
+			info.Requests++
+			info.LastControl = control
+			info.LastActive = time.Now()
+		}
+		if failed {
+			info.Errors++
+		}
+	}
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// deadlineReader 等待请求时使用空闲超时,收到第一个字节后使用读取超时
+type deadlineReader struct {
+	conn    net.Conn
+	idle    time.Duration
+	read    time.Duration
+	started bool
+}
+
+// reset 开始读取下一个请求
+func (this *deadlineReader) reset() {
+	this.started = false
+}
+
+func (this *deadlineReader) Read(p []byte) (int, error) {
+	if this.idle > 0 || this.read > 0 {
+		d := this.idle
+		if this.started {
+			d = this.read
+		}
+		deadline := time.Time{}
+		if d > 0 {
+			deadline = time.Now().Add(d)
+		}
+		if err := this.conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	n, err := this.conn.Read(p)
+	if n > 0 {
+		this.started = true
+	}
+	return n, err
+}
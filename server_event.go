@@ -0,0 +1,155 @@
+package modbus
+
+import (
+	"sync"
+	"time"
+)
+
+// WriteEvent 主站写入事件
+type WriteEvent struct {
+	Control      Control   //功能码
+	Key          string    //类型 KeyOutputCoils 或 KeyHoldingRegisters
+	Slave        byte      //从站地址
+	Address      uint16    //起始地址
+	Registers    []uint16  //写入的寄存器值
+	OldRegisters []uint16  //写入前的寄存器值,不能读取时为nil
+	Coils        []bool    //写入的线圈值
+	OldCoils     []bool    //写入前的线圈值,不能读取时为nil
+	Peer         string    //来源,TCP为远程地址,RTU为串口地址
+	Time         time.Time //写入时间
+}
+
+// newWriteEvent 根据写请求新建事件,不包含写入前的值
+func newWriteEvent(b *WriteBlock) *WriteEvent {
+	e := &WriteEvent{
+		Control: b.Control,
+		Key:     KeyHoldingRegisters,
+		Slave:   b.Slave,
+		Address: b.Address,
+		Peer:    b.Peer,
+		Time:    time.Now(),
+	}
+	if b.Registers != nil {
+		e.Registers = append([]uint16(nil), b.Registers...)
+	} else {
+		e.Key = KeyOutputCoils
+		e.Coils = append([]bool(nil), b.Coils...)
+	}
+	return e
+}
+
+// Changed 值有变化的地址,没有写入前的值时返回全部地址
+func (this *WriteEvent) Changed() []uint16 {
+	result := []uint16(nil)
+	for i := range this.Registers {
+		if this.OldRegisters == nil || this.Registers[i] != this.OldRegisters[i] {
+			result = append(result, this.Address+uint16(i))
+		}
+	}
+	for i := range this.Coils {
+		if this.OldCoils == nil || this.Coils[i] != this.OldCoils[i] {
+			result = append(result, this.Address+uint16(i))
+		}
+	}
+	return result
+}
+
+// WriteFilter 写入事件过滤,零值接收所有事件
+type WriteFilter struct {
+	Key      string //类型 KeyOutputCoils 或 KeyHoldingRegisters,为空时不限制
+	Start    uint16 //起始地址
+	Quantity uint16 //数量,0表示从Start到最后
+	Changed  bool   //只接收值有变化的事件
+}
+
+// match 事件的地址范围和过滤范围有重叠时匹配
+func (this *WriteFilter) match(e *WriteEvent) bool {
+	if this.Key != "" && this.Key != e.Key {
+		return false
+	}
+	n := len(e.Registers) + len(e.Coils)
+	end := 65536
+	if this.Quantity > 0 {
+		end = int(this.Start) + int(this.Quantity)
+	}
+	if int(e.Address)+n <= int(this.Start) || int(e.Address) >= end {
+		return false
+	}
+	if this.Changed {
+		for _, a := range e.Changed() {
+			if a >= this.Start && int(a) < end {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// writeSubs 写入事件的订阅者
+type writeSubs struct {
+	mu   sync.Mutex
+	id   int
+	subs map[int]*writeSub
+}
+
+type writeSub struct {
+	filter WriteFilter
+	fn     func(e *WriteEvent)
+}
+
+func (this *writeSubs) add(filter WriteFilter, fn func(e *WriteEvent)) func() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.subs == nil {
+		this.subs = make(map[int]*writeSub)
+	}
+	this.id++
+	id := this.id
+	this.subs[id] = &writeSub{filter: filter, fn: fn}
+	return func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		delete(this.subs, id)
+	}
+}
+
+func (this *writeSubs) len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.subs)
+}
+
+// publish 通知匹配的订阅者,在锁外回调
+func (this *writeSubs) publish(e *WriteEvent) {
+	this.mu.Lock()
+	subs := make([]*writeSub, 0, len(this.subs))
+	for _, sub := range this.subs {
+		subs = append(subs, sub)
+	}
+	this.mu.Unlock()
+	for _, sub := range subs {
+		if sub.filter.match(e) {
+			sub.fn(e)
+		}
+	}
+}
+
+// OnWrite 订阅主站写入线圈和保持寄存器的事件,写入成功后在处理请求的协程中回调
+// 返回取消订阅的函数
+func (this *Server) OnWrite(filter WriteFilter, fn func(e *WriteEvent)) func() {
+	return this.writeSubs.add(filter, fn)
+}
+
+// OnWriteChan 通过通道订阅写入事件,通道满时丢弃事件,不阻塞主站请求
+// 返回取消订阅的函数,取消后不会关闭通道
+func (this *Server) OnWriteChan(filter WriteFilter, size int) (<-chan *WriteEvent, func()) {
+	c := make(chan *WriteEvent, size)
+	cancel := this.OnWrite(filter, func(e *WriteEvent) {
+		select {
+		case c <- e:
+		default:
+		}
+	})
+	return c, cancel
+}
@@ -0,0 +1,218 @@
+package modbus
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Fault 故障注入,匹配的请求按故障响应,用于测试主站的异常处理
+// 条件为空时不限制,多个故障匹配时合并
+type Fault struct {
+	Slaves   []byte    //从站地址
+	Controls []Control //功能码
+	Start    uint16    //起始地址
+	Quantity uint16    //数量,0表示不限制地址,请求的地址范围有重叠时匹配
+
+	Probability float64 //触发概率,0表示每次都触发
+	Count       int     //触发次数,0表示不限制
+
+	Delay       time.Duration //延时响应
+	Drop        bool          //不响应,请求仍会执行
+	CorruptCRC  bool          //RTU响应的CRC错误
+	WrongOrder  bool          //TCP响应的事务号错误
+	WrongSlave  bool          //响应的从站地址错误,RTU会重新计算CRC
+	Truncate    int           //去掉响应末尾的字节数
+	Exception   Control       //不执行处理函数,响应该异常码,例DeviceBusy
+	BitFlipRate float64       //响应中每个位翻转的概率,例0.001
+}
+
+// match 请求是否匹配故障的条件
+func (this *Fault) match(f Frame) bool {
+	if len(this.Slaves) > 0 && !containsByte(this.Slaves, f.GetSlave()) {
+		return false
+	}
+	if len(this.Controls) > 0 {
+		found := false
+		for _, c := range this.Controls {
+			if c == f.GetControl() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if this.Quantity > 0 {
+		data := f.GetData()
+		if len(data) < 4 {
+			return false
+		}
+		address := uint16(data[0])<<8 | uint16(data[1])
+		quantity := uint16(data[2])<<8 | uint16(data[3])
+		switch f.GetControl() {
+		case WriteCoils, WriteRegisters, MaskWriteRegisters:
+			quantity = 1
+		}
+		end := int(this.Start) + int(this.Quantity)
+		if int(address)+int(quantity) <= int(this.Start) || int(address) >= end {
+			return false
+		}
+	}
+	return true
+}
+
+// merge 合并另一个故障的效果
+func (this *Fault) merge(f *Fault) {
+	if f.Delay > this.Delay {
+		this.Delay = f.Delay
+	}
+	if f.Truncate > this.Truncate {
+		this.Truncate = f.Truncate
+	}
+	if f.BitFlipRate > this.BitFlipRate {
+		this.BitFlipRate = f.BitFlipRate
+	}
+	if f.Exception != 0 {
+		this.Exception = f.Exception
+	}
+	this.Drop = this.Drop || f.Drop
+	this.CorruptCRC = this.CorruptCRC || f.CorruptCRC
+	this.WrongOrder = this.WrongOrder || f.WrongOrder
+	this.WrongSlave = this.WrongSlave || f.WrongSlave
+}
+
+// apply 按故障修改响应,返回nil表示不响应
+func (this *Fault) apply(bs []byte, transport string, r *rand.Rand) []byte {
+	if this.Drop {
+		return nil
+	}
+	bs = append([]byte(nil), bs...)
+	switch transport {
+	case TCP:
+		if this.WrongOrder && len(bs) >= 2 {
+			order := uint16(bs[0])<<8 | uint16(bs[1]) + 1
+			bs[0], bs[1] = byte(order>>8), byte(order)
+		}
+		if this.WrongSlave && len(bs) >= 7 {
+			bs[6]++
+		}
+	case RTU:
+		if this.WrongSlave && len(bs) >= 3 {
+			bs[0]++
+			copy(bs[len(bs)-2:], CRC(bs[:len(bs)-2]))
+		}
+		if this.CorruptCRC && len(bs) >= 2 {
+			bs[len(bs)-1] ^= 0xFF
+		}
+	}
+	flipBits(bs, this.BitFlipRate, r)
+	if this.Truncate > 0 {
+		if this.Truncate >= len(bs) {
+			return bs[:0]
+		}
+		bs = bs[:len(bs)-this.Truncate]
+	}
+	return bs
+}
+
+// flipBits 按概率翻转每个位
+func flipBits(bs []byte, rate float64, r *rand.Rand) {
+	if rate <= 0 {
+		return
+	}
+	for i := range bs {
+		for bit := uint(0); bit < 8; bit++ {
+			if r.Float64() < rate {
+				bs[i] ^= 1 << bit
+			}
+		}
+	}
+}
+
+// faults 注入的故障
+type faults struct {
+	mu   sync.Mutex
+	id   int
+	list map[int]*Fault
+	rand *rand.Rand
+}
+
+// AddFault 添加故障,运行中可以随时添加,返回移除该故障的函数
+func (this *Server) AddFault(f Fault) func() {
+	this.faults.mu.Lock()
+	defer this.faults.mu.Unlock()
+	if this.faults.list == nil {
+		this.faults.list = make(map[int]*Fault)
+	}
+	this.faults.id++
+	id := this.faults.id
+	this.faults.list[id] = &f
+	return func() {
+		this.faults.mu.Lock()
+		defer this.faults.mu.Unlock()
+		delete(this.faults.list, id)
+	}
+}
+
+// ClearFaults 移除所有故障
+func (this *Server) ClearFaults() {
+	this.faults.mu.Lock()
+	defer this.faults.mu.Unlock()
+	this.faults.list = nil
+}
+
+// SetFaultSeed 设置概率和位翻转的随机数种子,用于复现测试结果
+func (this *Server) SetFaultSeed(seed int64) *Server {
+	this.faults.mu.Lock()
+	defer this.faults.mu.Unlock()
+	this.faults.rand = rand.New(rand.NewSource(seed))
+	return this
+}
+
+// fault 合并匹配请求的故障,没有时返回nil,达到触发次数的故障会被移除
+func (this *Server) fault(f Frame) *Fault {
+	this.faults.mu.Lock()
+	defer this.faults.mu.Unlock()
+	if len(this.faults.list) == 0 {
+		return nil
+	}
+	if this.faults.rand == nil {
+		this.faults.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	ids := make([]int, 0, len(this.faults.list))
+	for id := range this.faults.list {
+		ids = append(ids, id)
+	}
+	//按添加顺序合并,保证随机数的使用顺序一致
+	for i := 1; i < len(ids); i++ {
+		for j := i; j > 0 && ids[j] < ids[j-1]; j-- {
+			ids[j], ids[j-1] = ids[j-1], ids[j]
+		}
+	}
+	var result *Fault
+	for _, id := range ids {
+		x := this.faults.list[id]
+		if !x.match(f) || (x.Probability > 0 && this.faults.rand.Float64() >= x.Probability) {
+			continue
+		}
+		if result == nil {
+			result = &Fault{}
+		}
+		result.merge(x)
+		if x.Count > 0 {
+			if x.Count--; x.Count == 0 {
+				delete(this.faults.list, id)
+			}
+		}
+	}
+	return result
+}
+
+// faultBytes 按故障修改响应
+func (this *Server) faultBytes(x *Fault, bs []byte, transport string) []byte {
+	this.faults.mu.Lock()
+	defer this.faults.mu.Unlock()
+	return x.apply(bs, transport, this.faults.rand)
+}
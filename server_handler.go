@@ -2,53 +2,203 @@ package modbus
 
 import (
 	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"sync"
+	"time"
 )
 
+// Handler 功能码处理函数,监听TCP和RTU时f是*Request,可以获取请求的来源
 type Handler func(f Frame) ([]byte, Control)
 
-func (this *Server) handle(f Frame, w io.Writer) (err error) {
-	origin := f.Copy()
+// Request 从站收到的请求,包含数据帧和来源
+type Request struct {
+	Frame
+	Peer      string //来源,TCP为远程地址,RTU为串口地址
+	Transport string //传输方式 "TCP" or "RTU"
+}
+
+// peerOf 获取请求的来源
+func peerOf(f Frame) string {
+	if r, ok := f.(*Request); ok {
+		return r.Peer
+	}
+	return ""
+}
+
+// handle 处理请求并发送响应,设置了追踪钩子时由钩子包裹
+func (this *Server) handle(f Frame, w io.Writer) error {
+	if this.trace != nil {
+		return this.trace(f, func() error { return this.serveFrame(f, w) })
+	}
+	return this.serveFrame(f, w)
+}
+
+// serveRequest 处理连接上的请求,处理时panic返回错误,只影响该连接,不会导致进程退出
+func (this *Server) serveRequest(f Frame, w io.Writer) (err error) {
 	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("处理请求异常:%v", e)
+		}
+	}()
+	return this.handle(f, w)
+}
+
+func (this *Server) serveFrame(f Frame, w io.Writer) (err error) {
+	start := time.Now()
+	slave, control := f.GetSlave(), f.GetControl()
+	logging := this.logging()
+	var origin Frame //请求的副本,只在日志,抓包和打印时复制
+	if logging || this.captureWriter != nil || this.printHandler != nil {
+		origin = f.Copy()
+	}
+	var fields []Field
+	if logging {
+		fields = frameFields(f)
+		fields = fields[:len(fields):len(fields)] //追加字段时不共用底层数组
+		this.log(LevelDebug, EventRx, append(fields, Field{FieldHex, origin.HEX()}, Field{FieldFrame, Dissect(origin, true)})...)
+	}
+	if this.captureWriter != nil {
+		this.capture(DirRx, f, origin.Bytes())
+	}
+	buf := replyPool.Get().(*[]byte)
+	defer replyPool.Put(buf)
+	var sent []byte //实际发送的响应,没有发送时为nil,引用buf
+	defer func() {
+		if err == nil && sent != nil && this.captureWriter != nil {
+			this.capture(DirTx, f, CopyBytes(sent))
+		}
 		if this.printHandler != nil {
 			this.printHandler(origin, f)
 		}
+		if err != nil {
+			return
+		}
+		failed := f.GetControl() != control
+		if this.metrics != nil {
+			this.metrics.Request(SideServer, slave, control, time.Since(start))
+			if failed {
+				this.metrics.Exception(SideServer, exception(f.GetControl(), f.GetData()))
+			}
+		}
+		if !logging {
+			return
+		}
+		if failed {
+			this.log(LevelWarn, EventException, append(fields, Field{FieldCode, byte(exception(f.GetControl(), f.GetData()))})...)
+		}
+		if sent != nil {
+			this.log(LevelDebug, EventTx, append(fields, Field{FieldLatency, time.Since(start)}, Field{FieldHex, hex.EncodeToString(sent)}, Field{FieldFrame, Dissect(f, false)})...)
+		}
 	}()
-	switch f.GetControl() {
-	case 1, 2, 3, 4, 5, 6, 15, 16:
-		handler := this.Handler[f.GetControl()]
-		if handler != nil {
-			result, control := handler(f)
-			if control != Success {
-				f.SetControl(control)
+
+	//先校验访问权限,拒绝时不执行处理函数,也不注入故障(不消耗故障的触发次数)
+	var fault *Fault
+	if code := this.access(f); code != Success {
+		setException(f, code)
+	} else if fault = this.fault(f); fault != nil && fault.Exception != 0 {
+		setException(f, fault.Exception)
+	} else {
+		switch f.GetControl() {
+		case 1, 2, 3, 4, 5, 6, 15, 16:
+			handler := this.Handler[f.GetControl()]
+			if handler != nil {
+				result, control := handler(f)
+				if control != Success {
+					setException(f, control)
+				} else {
+					f.SetData(result)
+				}
 			}
-			f.SetData(result)
+		default:
+			setException(f, IllegalFunction)
 		}
-	default:
-		f.SetControl(IllegalFunction)
 	}
-	_, err = w.Write(f.Bytes())
+	sent, err = this.reply(f, w, fault, (*buf)[:0])
 	return err
 }
 
+// replyPool 响应的编码缓存
+var replyPool = sync.Pool{New: func() interface{} {
+	bs := make([]byte, 0, 260)
+	return &bs
+}}
+
+// appendFrame 编码后追加到dst,不支持追加的数据帧按Bytes编码
+func appendFrame(dst []byte, f Frame) []byte {
+	if r, ok := f.(*Request); ok {
+		f = r.Frame
+	}
+	if a, ok := f.(interface{ AppendBytes([]byte) []byte }); ok {
+		return a.AppendBytes(dst)
+	}
+	return append(dst, f.Bytes()...)
+}
+
+// setException 设置为异常响应,功能码+0x80,数据域为异常码
+func setException(f Frame, code Control) {
+	f.SetControl(f.GetControl() | 0x80)
+	f.SetData([]byte{code.Byte() & 0x7F})
+}
+
+// reply 编码到buf后发送响应,返回实际发送的数据,有故障时按故障延时,修改或丢弃响应,RTU广播不响应
+func (this *Server) reply(f Frame, w io.Writer, fault *Fault, buf []byte) ([]byte, error) {
+	if f.Type() == RTU && f.GetSlave() == 0 {
+		return nil, nil
+	}
+	bs := appendFrame(buf, f)
+	if fault != nil {
+		if fault.Delay > 0 {
+			//关闭从站时不再等待
+			timer := time.NewTimer(fault.Delay)
+			select {
+			case <-timer.C:
+			case <-this.closing():
+				timer.Stop()
+				return nil, ErrServerClosed
+			}
+		}
+		if bs = this.faultBytes(fault, bs, f.Type()); bs == nil {
+			return nil, nil
+		}
+	}
+	if _, err := w.Write(bs); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
 // handler1 读线圈
 func (this *Server) handler1(f Frame) ([]byte, Control) {
+	if this.memory != nil {
+		return this.handlerReadMemory(f, KeyOutputCoils)
+	}
 	return this.handlerReadCoils(f, this.Coils.Get)
 }
 
 // handler2 读离散输入
 func (this *Server) handler2(f Frame) ([]byte, Control) {
+	if this.memory != nil {
+		return this.handlerReadMemory(f, KeyInputCoils)
+	}
 	return this.handlerReadCoils(f, this.DiscreteInputs.Get)
 }
 
 // handler3 读保持寄存器
 func (this *Server) handler3(f Frame) (result []byte, code Control) {
+	if this.memory != nil {
+		return this.handlerReadMemory(f, KeyHoldingRegisters)
+	}
 	return this.handlerReadRegister(f, this.HoldingRegisters.Get)
 }
 
 // handler4 读输入寄存器
 func (this *Server) handler4(f Frame) (result []byte, code Control) {
+	if this.memory != nil {
+		return this.handlerReadMemory(f, KeyInputRegisters)
+	}
 	return this.handlerReadRegister(f, this.InputRegisters.Get)
 }
 
@@ -57,14 +207,18 @@ func (this *Server) handler4(f Frame) (result []byte, code Control) {
 // [53 49 0 0 0 6 1 5 0 2 0 0]   //关
 func (this *Server) handler5(f Frame) ([]byte, Control) {
 	data := f.GetData()
-	start := 256*uint16(data[0]) + uint16(data[1])
-	value := data[2] == 255
-	if start == 0 {
-		return nil, IllegalAddress
+	if len(data) != 4 || data[3] != 0 || (data[2] != 0 && data[2] != 255) {
+		return nil, IllegalData
 	}
-	err := this.Coils.Get(start, 1)[0].Write(value)
-	if err != nil {
-		return nil, DeviceFault
+	start := 256*uint16(data[0]) + uint16(data[1])
+	if code := this.write(&WriteBlock{
+		Control: f.GetControl(),
+		Slave:   f.GetSlave(),
+		Peer:    peerOf(f),
+		Address: start,
+		Coils:   []bool{data[2] == 255},
+	}); code != Success {
+		return nil, code
 	}
 	return data, Success
 }
@@ -72,38 +226,46 @@ func (this *Server) handler5(f Frame) ([]byte, Control) {
 // handler6 写一个保持寄存器
 func (this *Server) handler6(f Frame) ([]byte, Control) {
 	data := f.GetData()
-	start := 256*uint16(data[0]) + uint16(data[1])
-	value := [2]byte{data[2], data[3]}
-	if start == 0 {
-		return nil, IllegalAddress
+	if len(data) != 4 {
+		return nil, IllegalData
 	}
-	err := this.HoldingRegisters.Get(start, 1)[0].Write(value)
-	if err != nil {
-		return nil, DeviceFault
+	start := 256*uint16(data[0]) + uint16(data[1])
+	if code := this.write(&WriteBlock{
+		Control:   f.GetControl(),
+		Slave:     f.GetSlave(),
+		Peer:      peerOf(f),
+		Address:   start,
+		Registers: []uint16{256*uint16(data[2]) + uint16(data[3])},
+	}); code != Success {
+		return nil, code
 	}
 	return data, Success
 }
 
 // handler15 写多个线圈
-// [0 2 0 1 1 1]
+// [0 2 0 10 2 205 1] 第一个字节的最低位为第一个线圈
 func (this *Server) handler15(f Frame) ([]byte, Control) {
 	data := f.GetData()
 	if len(data) < 5 {
-		return nil, IllegalAddress
+		return nil, IllegalData
 	}
-	start := 256*uint16(data[0]) + uint16(data[1])
-	count := 256*uint16(data[2]) + uint16(data[3])
-	list := BytesToBin(data[5:])
-	if int(count*8) != len(list) || start == 0 {
-		return nil, IllegalAddress
+	start, count, code := requestRange(data[:4], 1968)
+	if code != Success {
+		return nil, code
 	}
-	for i, v := range this.Coils.Get(start, count) {
-		if err := v.Write(list[i]); err != nil {
-			return nil, DeviceFault
-		}
-		data = data[2:]
+	if int(data[4]) != (int(count)+7)/8 || len(data[5:]) != int(data[4]) {
+		return nil, IllegalData
+	}
+	if code := this.write(&WriteBlock{
+		Control: f.GetControl(),
+		Slave:   f.GetSlave(),
+		Peer:    peerOf(f),
+		Address: start,
+		Coils:   BytesToCoils(data[5:], int(count)),
+	}); code != Success {
+		return nil, code
 	}
-	return f.GetData(), Success
+	return data[:4], Success
 }
 
 // handler16 写多个保持寄存器
@@ -111,33 +273,44 @@ func (this *Server) handler15(f Frame) ([]byte, Control) {
 func (this *Server) handler16(f Frame) ([]byte, Control) {
 	data := f.GetData()
 	if len(data) < 5 {
-		return nil, IllegalAddress
+		return nil, IllegalData
 	}
-	start := 256*uint16(data[0]) + uint16(data[1])
-	count := 256*uint16(data[2]) + uint16(data[3])
-	if count*2 != uint16(data[4]) || len(data[5:]) != int(data[4]) || start == 0 {
-		return nil, IllegalAddress
+	start, count, code := requestRange(data[:4], 123)
+	if code != Success {
+		return nil, code
 	}
-	data = data[5:]
-	for _, v := range this.HoldingRegisters.Get(start, count) {
-		if err := v.Write([2]byte{data[0], data[1]}); err != nil {
-			return nil, DeviceFault
-		}
-		data = data[2:]
+	if int(data[4]) != int(count)*2 || len(data[5:]) != int(data[4]) {
+		return nil, IllegalData
+	}
+	if code := this.write(&WriteBlock{
+		Control:   f.GetControl(),
+		Slave:     f.GetSlave(),
+		Peer:      peerOf(f),
+		Address:   start,
+		Registers: BytesToRegisters(data[5:]),
+	}); code != Success {
+		return nil, code
 	}
-	return f.GetData(), Success
+	return data[:4], Success
 }
 
 // handlerReadCoils 读线圈
 func (this *Server) handlerReadCoils(f Frame, fn func(uint16, uint16) []ReadWriteCoils) (result []byte, code Control) {
 	data := f.GetData()
-	start := 256*uint16(data[0]) + uint16(data[1])
-	count := 256*uint16(data[2]) + uint16(data[3])
+	if len(data) != 4 {
+		return nil, IllegalData
+	}
+	start, count, code := requestRange(data, 2000)
+	if code != Success {
+		return nil, code
+	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
 	value := []bool{}
 	for _, v := range fn(start, count) {
 		b, err := v.Read()
 		if err != nil {
-			return nil, IllegalFunction
+			return nil, DeviceFault
 		}
 		value = append(value, b)
 	}
@@ -147,8 +320,15 @@ func (this *Server) handlerReadCoils(f Frame, fn func(uint16, uint16) []ReadWrit
 // handlerReadRegister 读寄存器
 func (this *Server) handlerReadRegister(f Frame, fn func(uint16, uint16) []ReadWriteRegister) (result []byte, code Control) {
 	data := f.GetData()
-	start := 256*uint16(data[0]) + uint16(data[1])
-	count := 256*uint16(data[2]) + uint16(data[3])
+	if len(data) != 4 {
+		return nil, IllegalData
+	}
+	start, count, code := requestRange(data, 125)
+	if code != Success {
+		return nil, code
+	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
 	for _, v := range fn(start, count) {
 		bs, err := v.Read()
 		if err != nil {
@@ -160,37 +340,109 @@ func (this *Server) handlerReadRegister(f Frame, fn func(uint16, uint16) []ReadW
 	return
 }
 
-func (this *Server) defaultPrintHandler(origin, result Frame) {
-	if this.debug {
-		log.Printf("[Modbus][%s] %s >>> %s ", origin.Type(), origin.HEX(), result.HEX())
+// requestRange 解析请求的起始地址和数量,数量为0或超过limit时返回IllegalData,超出地址范围时返回IllegalAddress
+func requestRange(data []byte, limit int) (start, count uint16, code Control) {
+	start = 256*uint16(data[0]) + uint16(data[1])
+	count = 256*uint16(data[2]) + uint16(data[3])
+	if count < 1 || int(count) > limit {
+		return 0, 0, IllegalData
+	}
+	if int(start)+int(count) > 65536 {
+		return 0, 0, IllegalAddress
+	}
+	return start, count, Success
+}
+
+// handlerReadMemory 从存储中读取,范围读取是原子的
+func (this *Server) handlerReadMemory(f Frame, key string) ([]byte, Control) {
+	data := f.GetData()
+	if len(data) != 4 {
+		return nil, IllegalData
+	}
+	limit := 125
+	if key == KeyOutputCoils || key == KeyInputCoils {
+		limit = 2000
+	}
+	start, count, code := requestRange(data, limit)
+	if code != Success {
+		return nil, code
+	}
+	switch key {
+	case KeyOutputCoils:
+		return CoilsBytes(this.memory.GetCoils(start, count)), Success
+	case KeyInputCoils:
+		return CoilsBytes(this.memory.GetDiscreteInputs(start, count)), Success
+	case KeyInputRegisters:
+		bs := RegistersToBytes(this.memory.GetInputRegisters(start, count))
+		return append([]byte{byte(len(bs))}, bs...), Success
+	default:
+		bs := RegistersToBytes(this.memory.GetHoldingRegisters(start, count))
+		return append([]byte{byte(len(bs))}, bs...), Success
 	}
 }
 
 // ReadWithRTU 根据RTU数据格式读取数据,按字节(传输)读取
+// 已知长度的请求校验失败时,丢弃第一个字节重新同步,避免线路干扰后无法恢复
 func ReadWithRTU(buf *bufio.Reader) (*RTUFrame, error) {
+	f, _, _, err := readRTU(buf)
+	return f, err
+}
+
+// readRTU 同ReadWithRTU,并返回重新同步时丢弃的字节数,
+// 丢弃的数据正好是一个CRC校验失败的完整请求时crc为true,否则是杂散的字节
+func readRTU(buf *bufio.Reader) (f *RTUFrame, dropped int, crc bool, err error) {
 	bytes := []byte(nil)
+	crcLength := 0 //第一个CRC校验失败的请求长度
 	for {
 		b, err := buf.ReadByte()
 		if err != nil {
-			return nil, err
+			return nil, dropped, false, err
 		}
 		bytes = append(bytes, b)
-		if len(bytes) >= 8 {
-			f, err := DecodeRTU(bytes)
-			if err == nil {
-				return f, nil
+		for len(bytes) >= 8 {
+			n := rtuRequestLength(bytes)
+			if n == 0 {
+				//未知功能码,按CRC校验判断是否完整
+				if f, err := DecodeRTU(bytes); err == nil {
+					return f, dropped, dropped > 0 && dropped == crcLength, nil
+				}
+				if len(bytes) < 256 {
+					break
+				}
+			} else if len(bytes) < n {
+				break
+			} else if f, err := DecodeRTU(bytes[:n]); err == nil {
+				return f, dropped, dropped > 0 && dropped == crcLength, nil
+			} else if dropped == 0 && errors.Is(err, ErrCRC) {
+				crcLength = n
 			}
+			bytes = bytes[1:]
+			dropped++
 		}
 	}
 }
 
+// rtuRequestLength 根据功能码计算RTU请求帧的长度,未知功能码或数据不足时返回0
+func rtuRequestLength(bytes []byte) int {
+	switch Control(bytes[1]) {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters,
+		WriteCoils, WriteRegisters:
+		return 8
+	case WriteMultipleCoils, WriteMultipleRegisters:
+		if len(bytes) < 7 {
+			return 0
+		}
+		return 9 + int(bytes[6])
+	default:
+		return 0
+	}
+}
+
 // ReadWithTCP 根据TCP数据格式读取数据
 func ReadWithTCP(reader io.Reader) (*TCPFrame, error) {
-	buff := make([]byte, 512)
-	length, err := reader.Read(buff)
+	bytes, err := readTCP(reader)
 	if err != nil {
 		return nil, err
 	}
-	buff = buff[:length]
-	return DecodeTCP(buff)
+	return DecodeTCP(bytes)
 }
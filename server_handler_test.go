@@ -0,0 +1,458 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// newMemoryServer 测试用从站,寄存器和线圈保存在切片中
+func newMemoryServer(n int) (*Server, []uint16, []bool) {
+	s := NewServer()
+	registers, coils := make([]uint16, n), make([]bool, n)
+	for i := 0; i < n; i++ {
+		i := i
+		s.SetHoldingRegisters(uint16(i), ReadWriteRegister{
+			Read: func() ([2]byte, error) {
+				return [2]byte{byte(registers[i] >> 8), byte(registers[i])}, nil
+			},
+			Write: func(b [2]byte) error {
+				registers[i] = uint16(b[0])<<8 | uint16(b[1])
+				return nil
+			},
+		})
+		s.SetCoils(uint16(i), ReadWriteCoils{
+			Read:  func() (bool, error) { return coils[i], nil },
+			Write: func(b bool) error { coils[i] = b; return nil },
+		})
+	}
+	return s, registers, coils
+}
+
+// responseCode 响应的异常码,正常响应返回功能码
+func responseCode(f Frame) Control {
+	if code := exception(f.GetControl(), f.GetData()); code != Success {
+		return code
+	}
+	return f.GetControl()
+}
+
+func TestServerConstraint(t *testing.T) {
+	s, registers, coils := newMemoryServer(20)
+	s.AddRegisterConstraint(
+		Constraint{Start: 1, Quantity: 3, Min: -10, Max: 10, Signed: true},
+		Constraint{Start: 5, Enum: []uint16{1, 2, 3}},
+		Constraint{Start: 8, Quantity: 2, ReadOnly: true},
+	)
+	s.AddCoilConstraint(Constraint{Start: 4, ReadOnly: true})
+
+	for _, c := range []struct {
+		data []byte
+		code Control
+	}{
+		{[]byte{0, 1, 0, 3, 6, 0, 1, 0xFF, 0xF6, 0, 10}, Success},
+		{[]byte{0, 1, 0, 3, 6, 0, 2, 0, 3, 0, 11}, IllegalData},
+		{[]byte{0, 5, 0, 1, 2, 0, 4}, IllegalData},
+		{[]byte{0, 7, 0, 2, 4, 0, 1, 0, 1}, IllegalData},
+	} {
+		if _, code := s.handler16(&RTUFrame{Slave: 1, Control: WriteMultipleRegisters, Data: c.data}); code != c.code {
+			t.Errorf("%v 期望%v,实际%v", c.data, c.code, code)
+		}
+	}
+	if registers[1] != 1 || registers[2] != 0xFFF6 || registers[3] != 10 || registers[7] != 0 {
+		t.Error("违反约束时不能写入任何寄存器", registers)
+	}
+
+	//0b1011 第一个字节的最低位为第一个线圈
+	if _, code := s.handler15(&RTUFrame{Control: WriteMultipleCoils, Data: []byte{0, 1, 0, 3, 1, 0x05}}); code != Success {
+		t.Error(code)
+	}
+	if !coils[1] || coils[2] || !coils[3] {
+		t.Error("线圈写入顺序错误", coils[:4])
+	}
+	if _, code := s.handler5(&RTUFrame{Control: WriteCoils, Data: []byte{0, 4, 0xFF, 0}}); code != IllegalData {
+		t.Error("只读线圈", code)
+	}
+}
+
+func TestServerWriteHook(t *testing.T) {
+	s, registers, _ := newMemoryServer(10)
+	var block *WriteBlock
+	s.SetWriteHook(func(b *WriteBlock) error {
+		block = b
+		if b.Registers[0]+b.Registers[1] > 100 {
+			return errors.New("合计超出")
+		}
+		if b.Address == 5 {
+			return DeviceBusy
+		}
+		return nil
+	})
+	if _, code := s.handler16(&RTUFrame{Slave: 3, Control: WriteMultipleRegisters, Data: []byte{0, 1, 0, 2, 4, 0, 60, 0, 50}}); code != IllegalData {
+		t.Error(code)
+	}
+	if block == nil || block.Slave != 3 || block.Address != 1 || block.Quantity() != 2 || registers[1] != 0 {
+		t.Errorf("%+v", block)
+	}
+	if _, code := s.handler16(&RTUFrame{Control: WriteMultipleRegisters, Data: []byte{0, 5, 0, 2, 4, 0, 1, 0, 2}}); code != DeviceBusy {
+		t.Error(code)
+	}
+}
+
+type testBatch struct {
+	address uint16
+	values  []uint16
+}
+
+func (this *testBatch) WriteRegisters(address uint16, values []uint16) error {
+	this.address, this.values = address, values
+	return nil
+}
+
+func (this *testBatch) WriteCoils(address uint16, values []bool) error {
+	return errors.New("不支持")
+}
+
+func TestServerTransaction(t *testing.T) {
+	s, registers, _ := newMemoryServer(10)
+	s.SetHoldingRegisters(3, ReadWriteRegister{Write: func([2]byte) error { return errors.New("写入失败") }})
+	registers[1], registers[2] = 7, 8
+
+	//非事务模式,写入失败前的寄存器已经被修改
+	data := []byte{0, 1, 0, 3, 6, 0, 1, 0, 2, 0, 3}
+	if _, code := s.handler16(&RTUFrame{Control: WriteMultipleRegisters, Data: data}); code != DeviceFault {
+		t.Fatal(code)
+	}
+	if registers[1] != 1 || registers[2] != 2 {
+		t.Fatal(registers)
+	}
+
+	registers[1], registers[2] = 7, 8
+	s.Transaction()
+	if _, code := s.handler16(&RTUFrame{Control: WriteMultipleRegisters, Data: data}); code != DeviceFault {
+		t.Fatal(code)
+	}
+	if registers[1] != 7 || registers[2] != 8 {
+		t.Error("写入失败时应该回滚", registers)
+	}
+
+	batch := &testBatch{}
+	s.SetBatchWriter(batch)
+	if _, code := s.handler16(&RTUFrame{Control: WriteMultipleRegisters, Data: data}); code != Success {
+		t.Fatal(code)
+	}
+	if batch.address != 1 || len(batch.values) != 3 || batch.values[2] != 3 {
+		t.Error(batch)
+	}
+	if _, code := s.handler5(&RTUFrame{Control: WriteCoils, Data: []byte{0, 1, 0xFF, 0}}); code != DeviceFault {
+		t.Error(code)
+	}
+}
+
+func TestServerMemory(t *testing.T) {
+	m := NewMemory()
+	m.SetHoldingRegisters(10, 1, 2, 3)
+	m.SetCoils(0, true, false, true)
+	s := NewServer().SetMemory(m)
+
+	events := []*WriteEvent(nil)
+	cancel := m.Subscribe(func(e *WriteEvent) { events = append(events, e) })
+
+	req := &Request{
+		Frame: &RTUFrame{Slave: 1, Control: ReadHoldingRegisters, Data: []byte{0, 10, 0, 3}},
+		Peer:  "127.0.0.1:502",
+	}
+	if data, code := s.handler3(req); code != Success || string(data) != string([]byte{6, 0, 1, 0, 2, 0, 3}) {
+		t.Error(data, code)
+	}
+	if data, code := s.handler1(&RTUFrame{Control: ReadCoils, Data: []byte{0, 0, 0, 3}}); code != Success || string(data) != string([]byte{1, 0x05}) {
+		t.Error(data, code)
+	}
+	if _, code := s.handler3(&RTUFrame{Control: ReadHoldingRegisters, Data: []byte{0, 0, 0, 126}}); code != IllegalData {
+		t.Error(code)
+	}
+	if _, code := s.handler3(&RTUFrame{Control: ReadHoldingRegisters, Data: []byte{0xFF, 0xFF, 0, 2}}); code != IllegalAddress {
+		t.Error(code)
+	}
+
+	req.Frame = &RTUFrame{Slave: 1, Control: WriteMultipleRegisters, Data: []byte{0, 10, 0, 2, 4, 0, 1, 0, 9}}
+	if _, code := s.handler16(req); code != Success {
+		t.Error(code)
+	}
+	if v := m.GetHoldingRegisters(10, 3); v[0] != 1 || v[1] != 9 || v[2] != 3 {
+		t.Error(v)
+	}
+	if len(events) != 1 {
+		t.Fatal("期望1个写入事件,实际", len(events))
+	}
+	e := events[0]
+	if e.Key != KeyHoldingRegisters || e.Slave != 1 || e.Peer != "127.0.0.1:502" || e.OldRegisters[1] != 2 {
+		t.Error(e)
+	}
+	if c := e.Changed(); len(c) != 1 || c[0] != 11 {
+		t.Error(c)
+	}
+
+	cancel()
+	s.handler5(&RTUFrame{Control: WriteCoils, Data: []byte{0, 1, 0xFF, 0}})
+	if len(events) != 1 || !m.GetCoils(1, 1)[0] {
+		t.Error("取消订阅后不应收到事件", len(events))
+	}
+}
+
+func TestServerOnWrite(t *testing.T) {
+	s, registers, _ := newMemoryServer(20)
+	registers[5] = 7
+
+	all := []*WriteEvent(nil)
+	s.OnWrite(WriteFilter{}, func(e *WriteEvent) { all = append(all, e) })
+	c, cancel := s.OnWriteChan(WriteFilter{Key: KeyHoldingRegisters, Start: 6, Quantity: 2, Changed: true}, 4)
+	defer cancel()
+
+	req := &Request{Peer: "COM1", Transport: RTU}
+	for _, f := range []Frame{
+		&RTUFrame{Slave: 2, Control: WriteRegisters, Data: []byte{0, 5, 0, 8}},
+		&RTUFrame{Slave: 2, Control: WriteMultipleRegisters, Data: []byte{0, 4, 0, 3, 6, 0, 0, 0, 8, 0, 0}},
+		&RTUFrame{Slave: 2, Control: WriteMultipleRegisters, Data: []byte{0, 6, 0, 1, 2, 0, 3}},
+		&RTUFrame{Slave: 2, Control: WriteCoils, Data: []byte{0, 6, 0xFF, 0}},
+	} {
+		req.Frame = f
+		if _, code := s.Handler[req.GetControl()](req); code != Success {
+			t.Fatal(code)
+		}
+	}
+
+	if len(all) != 4 {
+		t.Fatal("期望4个写入事件,实际", len(all))
+	}
+	e := all[0]
+	if e.Control != WriteRegisters || e.Slave != 2 || e.Peer != "COM1" || e.Registers[0] != 8 || e.OldRegisters[0] != 7 {
+		t.Error(e)
+	}
+	if all[3].Key != KeyOutputCoils || !all[3].Coils[0] || all[3].OldCoils[0] {
+		t.Error(all[3])
+	}
+
+	//第二次写入6的值没有变化,线圈不在过滤范围
+	select {
+	case e := <-c:
+		if e.Address != 6 || e.Registers[0] != 3 {
+			t.Error(e)
+		}
+	default:
+		t.Error("没有收到事件")
+	}
+	if len(c) != 0 {
+		t.Error("不应收到多余的事件", len(c))
+	}
+}
+
+func TestServerAccess(t *testing.T) {
+	s, registers, _ := newMemoryServer(20)
+	if err := s.AddAccessRule(AccessRule{CIDR: "10.0.0.0/8/1"}); err == nil {
+		t.Error("网段错误时应返回错误")
+	}
+	if err := s.AddAccessRule(
+		AccessRule{CIDR: "192.168.1.10", Access: AccessAllow},
+		AccessRule{CIDR: "192.168.1.0/24", Start: 10, Quantity: 5, Access: AccessDeny, Code: IllegalAddress},
+		AccessRule{CIDR: "192.168.1.0/24", Access: AccessReadOnly},
+		AccessRule{Slaves: []byte{9}, Controls: []Control{ReadHoldingRegisters}, Access: AccessAllow},
+	); err != nil {
+		t.Fatal(err)
+	}
+	s.SetAccessDefault(AccessDeny)
+	decisions := []*AccessDecision(nil)
+	s.SetAccessHook(func(d *AccessDecision) { decisions = append(decisions, d) })
+
+	for _, c := range []struct {
+		peer string
+		f    *RTUFrame
+		code Control
+	}{
+		{"192.168.1.10:1000", &RTUFrame{Slave: 1, Control: WriteRegisters, Data: []byte{0, 12, 0, 1}}, WriteRegisters},
+		{"192.168.1.20:1000", &RTUFrame{Slave: 1, Control: ReadHoldingRegisters, Data: []byte{0, 8, 0, 3}}, IllegalAddress},
+		{"192.168.1.20:1000", &RTUFrame{Slave: 1, Control: ReadHoldingRegisters, Data: []byte{0, 1, 0, 3}}, ReadHoldingRegisters},
+		{"192.168.1.20:1000", &RTUFrame{Slave: 1, Control: WriteRegisters, Data: []byte{0, 1, 0, 5}}, IllegalFunction},
+		{"10.0.0.1:1000", &RTUFrame{Slave: 9, Control: ReadHoldingRegisters, Data: []byte{0, 1, 0, 1}}, ReadHoldingRegisters},
+		{"COM1", &RTUFrame{Slave: 1, Control: ReadHoldingRegisters, Data: []byte{0, 1, 0, 1}}, IllegalFunction},
+	} {
+		req := &Request{Frame: c.f, Peer: c.peer}
+		if err := s.handle(req, new(bytes.Buffer)); err != nil {
+			t.Fatal(err)
+		}
+		if code := responseCode(c.f); code != c.code {
+			t.Errorf("%s %v 期望%v,实际%v", c.peer, c.f.Data, c.code, code)
+		}
+	}
+	if registers[12] != 1 || registers[1] != 0 {
+		t.Error("只有允许的写入生效", registers)
+	}
+	if len(decisions) != 6 || decisions[3].Access != AccessReadOnly || decisions[3].Allowed || decisions[5].Rule != nil {
+		t.Error(decisions)
+	}
+}
+
+func TestServerLogger(t *testing.T) {
+	s, _, _ := newMemoryServer(10)
+	events := map[string][]Field{}
+	s.SetLogger(LoggerFunc(func(level Level, event string, fields ...Field) {
+		events[event] = fields
+	}))
+	traced := 0
+	s.SetTrace(func(f Frame, next func() error) error {
+		traced++
+		return next()
+	})
+
+	req := &Request{Frame: &RTUFrame{Slave: 3, Control: 0x2B, Data: []byte{0x0E}}, Peer: "COM2", Transport: RTU}
+	if err := s.handle(req, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if traced != 1 {
+		t.Error("追踪钩子应执行1次", traced)
+	}
+	for _, event := range []string{EventRx, EventException, EventTx} {
+		fields := map[string]interface{}{}
+		for _, f := range events[event] {
+			fields[f.Key] = f.Value
+		}
+		if fields[FieldPeer] != "COM2" || fields[FieldUnit] != byte(3) || fields[FieldControl] != byte(0x2B) {
+			t.Error(event, fields)
+		}
+		if event == EventException && fields[FieldCode] != byte(IllegalFunction) {
+			t.Error(event, fields)
+		}
+		if _, ok := fields[FieldLatency]; event == EventTx && !ok {
+			t.Error(event, fields)
+		}
+	}
+}
+
+func TestServerFault(t *testing.T) {
+	s, registers, _ := newMemoryServer(20)
+	s.SetFaultSeed(1)
+	read := func(f Frame) []byte {
+		buf := new(bytes.Buffer)
+		if err := s.handle(f, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	rtu := func(address uint16) *RTUFrame {
+		return &RTUFrame{Slave: 1, Control: ReadHoldingRegisters, Data: []byte{byte(address >> 8), byte(address), 0, 2}}
+	}
+
+	remove := s.AddFault(Fault{Slaves: []byte{1}, Start: 10, Quantity: 5, CorruptCRC: true})
+	if _, err := DecodeRTU(read(rtu(12))); err == nil {
+		t.Error("CRC应错误")
+	}
+	if _, err := DecodeRTU(read(rtu(1))); err != nil {
+		t.Error("地址不匹配时不注入故障", err)
+	}
+	remove()
+	if _, err := DecodeRTU(read(rtu(12))); err != nil {
+		t.Error("移除后不注入故障", err)
+	}
+
+	s.AddFault(Fault{Controls: []Control{WriteRegisters}, Drop: true, Count: 1})
+	write := &RTUFrame{Slave: 1, Control: WriteRegisters, Data: []byte{0, 3, 0, 7}}
+	if bs := read(write); len(bs) != 0 || registers[3] != 7 {
+		t.Error("丢弃响应时请求仍要执行", bs, registers[3])
+	}
+	if bs := read(write.Copy()); len(bs) == 0 {
+		t.Error("达到次数后不再注入故障")
+	}
+
+	s.AddFault(Fault{Slaves: []byte{2}, Exception: DeviceBusy})
+	f := &TCPFrame{Order: [2]byte{0, 5}, Slave: 2, Control: WriteRegisters, Data: []byte{0, 4, 0, 9}}
+	read(f)
+	if responseCode(f) != DeviceBusy || registers[4] != 0 {
+		t.Error("异常时不执行处理函数", f.Control, registers[4])
+	}
+
+	//拒绝访问的请求不注入故障,也不消耗触发次数
+	s.ClearFaults()
+	s.AddFault(Fault{Slaves: []byte{1}, Exception: DeviceBusy, Count: 1})
+	s.SetAccessDefault(AccessDeny)
+	f = &TCPFrame{Order: [2]byte{0, 5}, Slave: 1, Control: ReadHoldingRegisters, Data: []byte{0, 1, 0, 1}}
+	if read(&Request{Frame: f, Peer: "COM1"}); responseCode(f) != IllegalFunction {
+		t.Error("拒绝访问时响应访问控制的异常码", f.Control)
+	}
+	s.SetAccessDefault(AccessAllow)
+	f = &TCPFrame{Order: [2]byte{0, 5}, Slave: 1, Control: ReadHoldingRegisters, Data: []byte{0, 1, 0, 1}}
+	if read(f); responseCode(f) != DeviceBusy {
+		t.Error("允许访问后注入故障", f.Control)
+	}
+
+	s.ClearFaults()
+	s.AddFault(Fault{Slaves: []byte{3}, WrongOrder: true, WrongSlave: true, Truncate: 1})
+	bs := read(&TCPFrame{Order: [2]byte{0, 5}, Slave: 3, Control: ReadHoldingRegisters, Data: []byte{0, 1, 0, 1}})
+	if len(bs) != 10 || bs[1] != 6 || bs[6] != 4 {
+		t.Error(bs)
+	}
+}
+
+// captureList 保存抓包记录
+type captureList []*CaptureRecord
+
+func (this *captureList) WriteRecord(r *CaptureRecord) error {
+	*this = append(*this, r)
+	return nil
+}
+
+func TestServerFaultCapture(t *testing.T) {
+	//抓包和日志只记录实际发送的响应
+	s, _, _ := newMemoryServer(20)
+	records := &captureList{}
+	tx := 0
+	s.SetCapture(records).SetLogger(LoggerFunc(func(level Level, event string, fields ...Field) {
+		if event == EventTx {
+			tx++
+		}
+	}))
+	s.AddFault(Fault{Slaves: []byte{1}, Drop: true})
+	s.AddFault(Fault{Slaves: []byte{2}, CorruptCRC: true})
+	for _, c := range []struct {
+		slave byte
+		sent  bool
+	}{
+		{0, false}, //RTU广播
+		{1, false}, //丢弃
+		{2, true},  //CRC错误
+	} {
+		*records, tx = nil, 0
+		buf := new(bytes.Buffer)
+		req := &Request{Frame: &RTUFrame{Slave: c.slave, Control: WriteRegisters, Data: []byte{0, 3, 0, 7}}, Peer: "COM1", Transport: RTU}
+		if err := s.handle(req, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !c.sent {
+			if len(*records) != 1 || tx != 0 {
+				t.Error(c.slave, "没有发送时不应记录响应", len(*records), tx)
+			}
+			continue
+		}
+		if len(*records) != 2 || tx != 1 || !bytes.Equal((*records)[1].Bytes, buf.Bytes()) {
+			t.Errorf("%d 应记录实际发送的数据 %x", c.slave, buf.Bytes())
+		}
+	}
+}
+
+func TestServerShortFrame(t *testing.T) {
+	//数据长度不足时响应非法数据值,不能panic
+	mapped, _, _ := newMemoryServer(20)
+	memory := NewServer().SetMemory(NewMemory())
+	for _, s := range []*Server{mapped, memory} {
+		for _, control := range []Control{1, 2, 3, 4, 5, 6, 15, 16} {
+			for n := 0; n < 4; n++ {
+				f := &RTUFrame{Slave: 1, Control: control, Data: []byte{0, 1, 0, 1}[:n]}
+				if err := s.handle(f, new(bytes.Buffer)); err != nil {
+					t.Fatal(err)
+				}
+				if code := responseCode(f); code != IllegalData {
+					t.Errorf("功能码%d 数据长度%d 期望%v,实际%v", control, n, IllegalData, code)
+				}
+			}
+		}
+	}
+}
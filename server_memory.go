@@ -0,0 +1,137 @@
+package modbus
+
+import (
+	"sync"
+)
+
+// Memory 并发安全的寄存器和线圈存储,范围读取和整块写入都是原子的
+type Memory struct {
+	mu               sync.RWMutex
+	coils            [65536]bool
+	discreteInputs   [65536]bool
+	inputRegisters   [65536]uint16
+	holdingRegisters [65536]uint16
+	subs             writeSubs
+}
+
+// NewMemory 新建存储,初始值都为0
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// GetCoils 读取线圈快照
+func (this *Memory) GetCoils(address, quantity uint16) []bool {
+	return this.getBools(&this.coils, address, quantity)
+}
+
+// SetCoils 设置线圈
+func (this *Memory) SetCoils(address uint16, values ...bool) {
+	this.setBools(&this.coils, address, values)
+}
+
+// GetDiscreteInputs 读取离散输入快照
+func (this *Memory) GetDiscreteInputs(address, quantity uint16) []bool {
+	return this.getBools(&this.discreteInputs, address, quantity)
+}
+
+// SetDiscreteInputs 设置离散输入
+func (this *Memory) SetDiscreteInputs(address uint16, values ...bool) {
+	this.setBools(&this.discreteInputs, address, values)
+}
+
+// GetInputRegisters 读取输入寄存器快照
+func (this *Memory) GetInputRegisters(address, quantity uint16) []uint16 {
+	return this.getUint16s(&this.inputRegisters, address, quantity)
+}
+
+// SetInputRegisters 设置输入寄存器
+func (this *Memory) SetInputRegisters(address uint16, values ...uint16) {
+	this.setUint16s(&this.inputRegisters, address, values)
+}
+
+// GetHoldingRegisters 读取保持寄存器快照
+func (this *Memory) GetHoldingRegisters(address, quantity uint16) []uint16 {
+	return this.getUint16s(&this.holdingRegisters, address, quantity)
+}
+
+// SetHoldingRegisters 设置保持寄存器
+func (this *Memory) SetHoldingRegisters(address uint16, values ...uint16) {
+	this.setUint16s(&this.holdingRegisters, address, values)
+}
+
+// WriteRegisters 整块写入保持寄存器,实现BatchWriter
+func (this *Memory) WriteRegisters(address uint16, values []uint16) error {
+	this.SetHoldingRegisters(address, values...)
+	return nil
+}
+
+// WriteCoils 整块写入线圈,实现BatchWriter
+func (this *Memory) WriteCoils(address uint16, values []bool) error {
+	this.SetCoils(address, values...)
+	return nil
+}
+
+// Subscribe 订阅主站写入事件,返回取消订阅的函数
+// 和Server.OnWrite使用相同的订阅机制,等同于不过滤的订阅
+func (this *Memory) Subscribe(fn func(e *WriteEvent)) func() {
+	return this.subs.add(WriteFilter{}, fn)
+}
+
+// write 主站写入,记录写入前的值,并通知订阅者
+func (this *Memory) write(b *WriteBlock) *WriteEvent {
+	e := newWriteEvent(b)
+	this.mu.Lock()
+	if b.Registers != nil {
+		e.OldRegisters = make([]uint16, len(b.Registers))
+		for i, v := range b.Registers {
+			e.OldRegisters[i] = this.holdingRegisters[uint16(int(b.Address)+i)]
+			this.holdingRegisters[uint16(int(b.Address)+i)] = v
+		}
+	} else {
+		e.OldCoils = make([]bool, len(b.Coils))
+		for i, v := range b.Coils {
+			e.OldCoils[i] = this.coils[uint16(int(b.Address)+i)]
+			this.coils[uint16(int(b.Address)+i)] = v
+		}
+	}
+	this.mu.Unlock()
+
+	this.subs.publish(e)
+	return e
+}
+
+func (this *Memory) getBools(list *[65536]bool, address, quantity uint16) []bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	result := make([]bool, quantity)
+	for i := range result {
+		result[i] = list[uint16(int(address)+i)]
+	}
+	return result
+}
+
+func (this *Memory) setBools(list *[65536]bool, address uint16, values []bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, v := range values {
+		list[uint16(int(address)+i)] = v
+	}
+}
+
+func (this *Memory) getUint16s(list *[65536]uint16, address, quantity uint16) []uint16 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	result := make([]uint16, quantity)
+	for i := range result {
+		result[i] = list[uint16(int(address)+i)]
+	}
+	return result
+}
+
+func (this *Memory) setUint16s(list *[65536]uint16, address uint16, values []uint16) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, v := range values {
+		list[uint16(int(address)+i)] = v
+	}
+}
@@ -6,11 +6,12 @@ type ReadWriteRegister struct {
 	Write func([2]byte) error
 }
 
-type Register [65535]ReadWriteRegister
+type Register [65536]ReadWriteRegister
 
-func (this Register) Get(start, count uint16) (result []ReadWriteRegister) {
-	for i := start; i < start+count; i++ {
-		if i < 65535 {
+func (this *Register) Get(start, count uint16) (result []ReadWriteRegister) {
+	//按int计算,避免地址0xFFFF附近溢出
+	for i := int(start); i < int(start)+int(count); i++ {
+		if i < len(this) {
 			l := this[i]
 			if l.Read == nil {
 				l.Read = func() (result [2]byte, err error) { return }
@@ -35,11 +36,12 @@ type ReadWriteCoils struct {
 	Write func(bool) error
 }
 
-type Coils [65535]ReadWriteCoils
+type Coils [65536]ReadWriteCoils
 
-func (this Coils) Get(start, count uint16) (result []ReadWriteCoils) {
-	for i := start; i < start+count; i++ {
-		if i < 65535 {
+func (this *Coils) Get(start, count uint16) (result []ReadWriteCoils) {
+	//按int计算,避免地址0xFFFF附近溢出
+	for i := int(start); i < int(start)+int(count); i++ {
+		if i < len(this) {
 			l := this[i]
 			if l.Read == nil {
 				l.Read = func() (result bool, err error) { return }
@@ -1,19 +1,15 @@
 package modbus
 
 import (
+	"context"
+	"errors"
+	"net"
 	"testing"
+	"time"
 )
 
-/*
-01 00 00 00 00 06 01
-*/
 func TestNewServer(t *testing.T) {
 	s := NewServer()
-	s.Debug()
-	if err := s.ListenTCP(503); err != nil {
-		t.Error(err)
-		return
-	}
 	testR := [2]byte{1, 2}
 	s.SetHoldingRegisters(1, ReadWriteRegister{
 		Read: func() ([2]byte, error) {
@@ -28,10 +24,6 @@ func TestNewServer(t *testing.T) {
 		Read: func() ([2]byte, error) {
 			return testR, nil
 		},
-		Write: func(bytes [2]byte) error {
-			testR = bytes
-			return nil
-		},
 	})
 	testC := true
 	s.SetCoils(2, ReadWriteCoils{
@@ -44,5 +36,211 @@ func TestNewServer(t *testing.T) {
 		},
 	})
 
-	select {}
+	c, err := s.PipeTCP(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(time.Second)
+	if v, err := c.ReadHoldingRegisters(1, 1); err != nil || v[0] != 0x0102 {
+		t.Fatal(v, err)
+	}
+	if _, err := c.WriteRegisters(1, 0x0304); err != nil || testR != [2]byte{3, 4} {
+		t.Fatal(testR, err)
+	}
+	if v, err := c.ReadInputRegisters(1, 1); err != nil || v[0] != 0x0304 {
+		t.Fatal(v, err)
+	}
+	if v, err := c.ReadOutputCoils(2, 1); err != nil || !v[0] {
+		t.Fatal(v, err)
+	}
+	if _, err := c.WriteCoils(2, false); err != nil || testC {
+		t.Fatal(testC, err)
+	}
+	if len(s.Connections()) != 1 {
+		t.Error("内存管道也记录连接")
+	}
+}
+
+func TestServerPipeRTU(t *testing.T) {
+	s := newTestServer()
+	defer s.Shutdown(context.Background())
+
+	//9600波特率,请求8字节,响应7字节,约17ms
+	c, err := s.PipeRTU(1, &PipeConfig{BaudRate: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(time.Second)
+	start := time.Now()
+	if v, err := c.ReadHoldingRegisters(5, 1); err != nil || v[0] != 5 {
+		t.Fatal(v, err)
+	}
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Error("应模拟传输耗时", d)
+	}
+	c.Close()
+
+	//线路干扰时部分请求失败,之后的请求能恢复
+	c, err = s.PipeRTU(1, &PipeConfig{NoiseRate: 0.005, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(100 * time.Millisecond)
+	success, failed := 0, 0
+	for i := uint16(0); i < 20; i++ {
+		if v, err := c.ReadHoldingRegisters(i, 1); err == nil && v[0] == i {
+			success++
+		} else {
+			failed++
+		}
+	}
+	if success == 0 || failed == 0 {
+		t.Error("成功", success, "失败", failed)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := newTestServer()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- s.Serve(listen) }()
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if s.Addr().String() != listen.Addr().String() {
+		t.Error(s.Addr())
+	}
+
+	c, err := DialTCP(s.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(time.Second)
+	if v, err := c.ReadHoldingRegisters(5, 1); err != nil || v[0] != 5 {
+		t.Fatal(v, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+	if err := <-errs; err != ErrServerClosed {
+		t.Error("期望ErrServerClosed,实际", err)
+	}
+	//已建立的连接也被关闭
+	if _, err := c.ReadHoldingRegisters(5, 1); err == nil {
+		t.Error("关闭后不应能读取")
+	}
+	if err := s.ListenAndServe("127.0.0.1:0"); err != ErrServerClosed {
+		t.Error("期望ErrServerClosed,实际", err)
+	}
+}
+
+func TestServerShutdownFaultDelay(t *testing.T) {
+	//故障延时中的请求不应阻塞关闭
+	s := newTestServer()
+	s.AddFault(Fault{Delay: time.Hour})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listen)
+	c, err := DialTCP(listen.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.SetTimeout(time.Hour).ReadHoldingRegisters(5, 1)
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Error("关闭时不应等待故障延时", err)
+	}
+}
+
+func TestServerConnections(t *testing.T) {
+	s := newTestServer().SetMaxConnsPerIP(1).SetDropPolicy(DropOldest).SetIdleTimeout(300 * time.Millisecond)
+	s.SetHoldingRegisters(200, ReadWriteRegister{
+		Read: func() ([2]byte, error) { return [2]byte{}, errors.New("设备故障") },
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listen)
+	defer s.Shutdown(context.Background())
+
+	dial := func() *Client {
+		c, err := DialTCP(listen.Addr().String(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetTimeout(time.Second)
+		if _, err := c.ReadHoldingRegisters(1, 1); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	first := dial()
+	defer first.Close()
+	second := dial()
+	defer second.Close()
+	second.ReadHoldingRegisters(200, 1)
+
+	//同一个IP只能有1个连接,最早的连接被关闭
+	if _, err := first.ReadHoldingRegisters(1, 1); err == nil {
+		t.Error("最早的连接应被关闭")
+	}
+	list := s.Connections()
+	if len(list) != 1 {
+		t.Fatal("期望1个连接,实际", len(list))
+	}
+	if list[0].Requests != 2 || list[0].Errors != 1 || list[0].LastControl != ReadHoldingRegisters {
+		t.Errorf("%+v", list[0])
+	}
+
+	//空闲超时后关闭连接
+	time.Sleep(500 * time.Millisecond)
+	if n := len(s.Connections()); n != 0 {
+		t.Error("空闲连接应被关闭", n)
+	}
+}
+
+func TestServerPanic(t *testing.T) {
+	s := newTestServer()
+	defer s.Shutdown(context.Background())
+	s.SetHandler(4, func(f Frame) ([]byte, Control) { panic("处理函数异常") })
+
+	c, err := s.PipeTCP(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(time.Second)
+	if _, err := c.ReadInputRegisters(1, 1); err == nil {
+		t.Error("处理函数panic时应断开连接")
+	}
+
+	//panic只影响该连接
+	c, err = s.PipeRTU(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTimeout(100 * time.Millisecond)
+	if _, err := c.ReadInputRegisters(1, 1); err == nil {
+		t.Error("处理函数panic时不响应")
+	}
+	if v, err := c.ReadHoldingRegisters(5, 1); err != nil || v[0] != 5 {
+		t.Error(v, err)
+	}
 }
@@ -0,0 +1,251 @@
+package modbus
+
+// WriteBlock 一次写请求的全部数据,写单个线圈或寄存器时数量为1
+type WriteBlock struct {
+	Control   Control  //功能码
+	Slave     byte     //从站地址
+	Address   uint16   //起始地址
+	Registers []uint16 //写保持寄存器的值
+	Coils     []bool   //写线圈的值
+	Peer      string   //来源,TCP为远程地址,RTU为串口地址
+}
+
+// Quantity 写入的数量
+func (this *WriteBlock) Quantity() uint16 {
+	if this.Registers != nil {
+		return uint16(len(this.Registers))
+	}
+	return uint16(len(this.Coils))
+}
+
+// BatchWriter 批量写入,整块写入要么全部成功,要么全部失败
+// 事务模式下设置后,写线圈和保持寄存器时通过该接口提交
+type BatchWriter interface {
+	WriteRegisters(address uint16, values []uint16) error
+	WriteCoils(address uint16, values []bool) error
+}
+
+// Constraint 写入约束,违反约束时整个请求都不写入,响应IllegalData
+type Constraint struct {
+	Start    uint16   //起始地址
+	Quantity uint16   //数量,0按1处理
+	ReadOnly bool     //只读,禁止主站写入
+	Min      float64  //最小值,Min和Max都为0时不限制范围
+	Max      float64  //最大值
+	Signed   bool     //按int16比较范围,默认按uint16
+	Enum     []uint16 //允许的值,为空时不限制,线圈为0或1
+}
+
+// contains 地址是否在约束范围内
+func (this *Constraint) contains(address uint16) bool {
+	quantity := this.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	return address >= this.Start && int(address) < int(this.Start)+int(quantity)
+}
+
+// allow 是否允许写入该值
+func (this *Constraint) allow(value uint16) bool {
+	if this.ReadOnly {
+		return false
+	}
+	if this.Min != 0 || this.Max != 0 {
+		v := float64(value)
+		if this.Signed {
+			v = float64(int16(value))
+		}
+		if v < this.Min || v > this.Max {
+			return false
+		}
+	}
+	if len(this.Enum) > 0 {
+		for _, e := range this.Enum {
+			if e == value {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// AddRegisterConstraint 添加保持寄存器的写入约束
+func (this *Server) AddRegisterConstraint(c ...Constraint) *Server {
+	this.registerConstraints = append(this.registerConstraints, c...)
+	return this
+}
+
+// AddCoilConstraint 添加线圈的写入约束,值按0或1比较
+func (this *Server) AddCoilConstraint(c ...Constraint) *Server {
+	this.coilConstraints = append(this.coilConstraints, c...)
+	return this
+}
+
+// SetWriteHook 设置写入钩子,在约束校验通过后,写入之前执行,可以看到整个写请求的数据
+// 返回错误时整个请求都不写入,错误是Control(例DeviceBusy)时响应该异常码,否则响应IllegalData
+func (this *Server) SetWriteHook(fn func(b *WriteBlock) error) *Server {
+	this.writeHook = fn
+	return this
+}
+
+// Transaction 事务模式,写多个线圈和寄存器时整块写入,失败时回滚已写入的值
+func (this *Server) Transaction(b ...bool) *Server {
+	this.transaction = !(len(b) > 0 && !b[0])
+	return this
+}
+
+// SetBatchWriter 设置批量写入接口,事务模式下有效
+func (this *Server) SetBatchWriter(w BatchWriter) *Server {
+	this.batchWriter = w
+	return this
+}
+
+// check 校验写入约束和钩子
+func (this *Server) check(b *WriteBlock) Control {
+	constraints, values := this.registerConstraints, b.Registers
+	if b.Registers == nil {
+		constraints, values = this.coilConstraints, make([]uint16, len(b.Coils))
+		for i, v := range b.Coils {
+			if v {
+				values[i] = 1
+			}
+		}
+	}
+	for i, v := range values {
+		address := b.Address + uint16(i)
+		for _, c := range constraints {
+			if c.contains(address) && !c.allow(v) {
+				return IllegalData
+			}
+		}
+	}
+	if this.writeHook != nil {
+		if err := this.writeHook(b); err != nil {
+			if code, ok := err.(Control); ok {
+				return code
+			}
+			return IllegalData
+		}
+	}
+	return Success
+}
+
+// write 校验通过后再写入,任意一个值违反约束时都不写入,写入成功后通知订阅者
+func (this *Server) write(b *WriteBlock) Control {
+	if code := this.check(b); code != Success {
+		return code
+	}
+	//设置了存储时直接整块写入存储
+	if this.memory != nil {
+		this.writeSubs.publish(this.memory.write(b))
+		return Success
+	}
+	e, code := this.writeBlock(b, this.writeSubs.len() > 0)
+	if e != nil {
+		this.writeSubs.publish(e)
+	}
+	return code
+}
+
+// writeBlock 写入接口,有订阅时读取写入前的值
+// 事务模式下整块写入,失败时回滚,读请求只能看到写入前或写入后的整块数据
+func (this *Server) writeBlock(b *WriteBlock, event bool) (*WriteEvent, Control) {
+	if !this.transaction {
+		this.mu.RLock()
+		defer this.mu.RUnlock()
+		var previous *WriteBlock
+		if event {
+			previous, _ = this.readBlock(b)
+		}
+		if _, err := this.apply(b); err != nil {
+			return nil, DeviceFault
+		}
+		return blockEvent(b, previous, event), Success
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.batchWriter != nil {
+		var err error
+		if b.Registers != nil {
+			err = this.batchWriter.WriteRegisters(b.Address, b.Registers)
+		} else {
+			err = this.batchWriter.WriteCoils(b.Address, b.Coils)
+		}
+		if err != nil {
+			return nil, DeviceFault
+		}
+		return blockEvent(b, nil, event), Success
+	}
+	//写入前读取原值,写入失败时回滚
+	previous, err := this.readBlock(b)
+	if err != nil {
+		return nil, DeviceFault
+	}
+	if n, err := this.apply(b); err != nil {
+		if previous.Registers != nil {
+			previous.Registers = previous.Registers[:n]
+		} else {
+			previous.Coils = previous.Coils[:n]
+		}
+		this.apply(previous)
+		return nil, DeviceFault
+	}
+	return blockEvent(b, previous, event), Success
+}
+
+// blockEvent 新建写入事件,previous为写入前的值,可以为nil
+func blockEvent(b, previous *WriteBlock, event bool) *WriteEvent {
+	if !event {
+		return nil
+	}
+	e := newWriteEvent(b)
+	if previous != nil {
+		e.OldRegisters, e.OldCoils = previous.Registers, previous.Coils
+	}
+	return e
+}
+
+// readBlock 读取写请求范围内的当前值
+func (this *Server) readBlock(b *WriteBlock) (*WriteBlock, error) {
+	result := &WriteBlock{Control: b.Control, Slave: b.Slave, Address: b.Address}
+	if b.Registers != nil {
+		result.Registers = make([]uint16, 0, len(b.Registers))
+		for _, v := range this.HoldingRegisters.Get(b.Address, b.Quantity()) {
+			bs, err := v.Read()
+			if err != nil {
+				return nil, err
+			}
+			result.Registers = append(result.Registers, uint16(bs[0])<<8|uint16(bs[1]))
+		}
+		return result, nil
+	}
+	result.Coils = make([]bool, 0, len(b.Coils))
+	for _, v := range this.Coils.Get(b.Address, b.Quantity()) {
+		value, err := v.Read()
+		if err != nil {
+			return nil, err
+		}
+		result.Coils = append(result.Coils, value)
+	}
+	return result, nil
+}
+
+// apply 逐个写入,返回写入成功的数量
+func (this *Server) apply(b *WriteBlock) (int, error) {
+	if b.Registers != nil {
+		for i, v := range this.HoldingRegisters.Get(b.Address, b.Quantity()) {
+			if err := v.Write([2]byte{byte(b.Registers[i] >> 8), byte(b.Registers[i])}); err != nil {
+				return i, err
+			}
+		}
+		return len(b.Registers), nil
+	}
+	for i, v := range this.Coils.Get(b.Address, b.Quantity()) {
+		if err := v.Write(b.Coils[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(b.Coils), nil
+}
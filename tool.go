@@ -7,6 +7,49 @@ import (
 )
 
 func ToBytes(any interface{}) ([]byte, error) {
+	//常用类型直接编码,避免binary.Write的反射
+	switch v := any.(type) {
+	case uint8:
+		return []byte{v}, nil
+	case int8:
+		return []byte{byte(v)}, nil
+	case uint16:
+		bs := make([]byte, 2)
+		binary.BigEndian.PutUint16(bs, v)
+		return bs, nil
+	case int16:
+		bs := make([]byte, 2)
+		binary.BigEndian.PutUint16(bs, uint16(v))
+		return bs, nil
+	case uint32:
+		bs := make([]byte, 4)
+		binary.BigEndian.PutUint32(bs, v)
+		return bs, nil
+	case int32:
+		bs := make([]byte, 4)
+		binary.BigEndian.PutUint32(bs, uint32(v))
+		return bs, nil
+	case float32:
+		bs := make([]byte, 4)
+		binary.BigEndian.PutUint32(bs, math.Float32bits(v))
+		return bs, nil
+	case uint64:
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, v)
+		return bs, nil
+	case int64:
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, uint64(v))
+		return bs, nil
+	case float64:
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, math.Float64bits(v))
+		return bs, nil
+	case []byte:
+		return CopyBytes(v), nil
+	case []uint16:
+		return RegistersToBytes(v), nil
+	}
 	bytesBuffer := bytes.NewBuffer([]byte{})
 	err := binary.Write(bytesBuffer, binary.BigEndian, any)
 	return bytesBuffer.Bytes(), err
@@ -66,9 +109,37 @@ func CoilsBytes(value []bool) (result []byte) {
 }
 
 func CopyBytes(bytes []byte) []byte {
-	result := []byte{}
-	for _, v := range bytes {
-		result = append(result, v)
+	return append(make([]byte, 0, len(bytes)), bytes...)
+}
+
+// BytesToCoils 线圈字节转线圈状态,每个字节从低位开始,返回quantity个
+// 和BytesToBin不同,BytesToBin是从高位开始的
+func BytesToCoils(bytes []byte, quantity int) []bool {
+	list := make([]bool, 0, quantity)
+	for i := 0; i < quantity && i/8 < len(bytes); i++ {
+		list = append(list, bytes[i/8]&(1<<uint(i%8)) != 0)
+	}
+	return list
+}
+
+// BytesToRegisters 字节转寄存器,每2个字节一个寄存器,高字节在前
+func BytesToRegisters(bytes []byte) []uint16 {
+	list := make([]uint16, len(bytes)/2)
+	for i := range list {
+		list[i] = uint16(bytes[i*2])<<8 | uint16(bytes[i*2+1])
+	}
+	return list
+}
+
+// RegistersToBytes 寄存器转字节,高字节在前
+func RegistersToBytes(registers []uint16) []byte {
+	bytes := make([]byte, 0, len(registers)*2)
+	for _, v := range registers {
+		bytes = append(bytes, byte(v>>8), byte(v))
 	}
-	return result
+	return bytes
+}
+
+func uint16ToBytes(n uint16) []byte {
+	return []byte{byte(n >> 8), byte(n)}
 }
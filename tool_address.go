@@ -0,0 +1,87 @@
+package modbus
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ParseAddress 解析地址,返回类型(KeyOutputCoils等)和从0开始的地址
+// 支持的格式:
+//
+//	4x40001 4x400001 类型前缀加Modicon地址,地址以类型数字开头,从1开始
+//	4x1 4x00001      类型前缀加从1开始的编号
+//	40001 400001     5位或6位Modicon地址,第一位为类型,从1开始
+//	hr:0 ir:0 co:0 di:0 类型缩写加从0开始的地址
+func ParseAddress(s string) (key string, address uint16, err error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	fail := func() (string, uint16, error) {
+		return "", 0, errors.New("地址格式错误:" + s)
+	}
+	if i := strings.Index(s, ":"); i > 0 {
+		switch s[:i] {
+		case "co", "coil", "coils":
+			key = KeyOutputCoils
+		case "di":
+			key = KeyInputCoils
+		case "ir":
+			key = KeyInputRegisters
+		case "hr":
+			key = KeyHoldingRegisters
+		default:
+			return fail()
+		}
+		n, err := strconv.ParseUint(s[i+1:], 10, 16)
+		if err != nil {
+			return fail()
+		}
+		return key, uint16(n), nil
+	}
+
+	var ref string
+	switch {
+	case len(s) > 2 && s[1] == 'x':
+		key, ref = addressKey(s[0]), s[2:]
+		//前缀后是完整的Modicon地址时去掉类型数字
+		if len(ref) >= 5 && ref[0] == s[0] {
+			ref = ref[1:]
+		}
+	case len(s) == 5 || len(s) == 6:
+		key, ref = addressKey(s[0]), s[1:]
+	default:
+		return fail()
+	}
+	n, err := strconv.ParseUint(ref, 10, 32)
+	if key == "" || err != nil || n < 1 || n > 65536 {
+		return fail()
+	}
+	return key, uint16(n - 1), nil
+}
+
+// FormatAddress 地址转成 4x40001 格式,地址大于9998时使用6位
+func FormatAddress(key string, address uint16) string {
+	digit := strings.ToLower(key)[:1]
+	ref := strconv.Itoa(int(address) + 1)
+	width := 4
+	if address > 9998 {
+		width = 5
+	}
+	if len(ref) < width {
+		ref = strings.Repeat("0", width-len(ref)) + ref
+	}
+	return digit + "x" + digit + ref
+}
+
+func addressKey(b byte) string {
+	switch b {
+	case '0':
+		return KeyOutputCoils
+	case '1':
+		return KeyInputCoils
+	case '3':
+		return KeyInputRegisters
+	case '4':
+		return KeyHoldingRegisters
+	}
+	return ""
+}
@@ -41,6 +41,12 @@ var crcLowBytes = []byte{
 }
 
 func CRC(bs []byte) []byte {
+	checksum := CRC16(bs)
+	return []byte{byte(checksum), byte(checksum >> 8)}
+}
+
+// CRC16 计算CRC校验值,不分配内存,RTU帧中低字节在前
+func CRC16(bs []byte) uint16 {
 	var (
 		low  byte = 0xFF
 		high byte = 0xFF
@@ -51,6 +57,5 @@ func CRC(bs []byte) []byte {
 		low = high ^ crcHighBytes[idx]
 		high = crcLowBytes[idx]
 	}
-	checksum := uint16(high)<<8 | uint16(low)
-	return []byte{byte(checksum), byte(checksum >> 8)}
+	return uint16(high)<<8 | uint16(low)
 }
@@ -2,6 +2,7 @@ package modbus
 
 import (
 	"encoding/hex"
+	"math"
 	"testing"
 )
 
@@ -11,9 +12,13 @@ func TestBinToByte(t *testing.T) {
 
 func TestEntity(t *testing.T) {
 	x := NewRTU(5)
-	bytes, err := x.WriteMultipleCoils(19, 10, []bool{
-		true, false, true, true, false, false, true, true, true, false})
-	t.Error(err)
+	data := []byte{0, 19, 0, 10}
+	data = append(data, CoilsBytes([]bool{
+		true, false, true, true, false, false, true, true, true, false})...)
+	bytes, err := x.Encode(WriteMultipleCoils, data)
+	if err != nil {
+		t.Error(err)
+	}
 	t.Log(hex.EncodeToString(bytes))
 }
 
@@ -21,3 +26,78 @@ func TestByteToBin(t *testing.T) {
 	t.Log(ByteToBin(0xcd))
 	t.Log(BytesToBin([]byte{0xcd, 0x01}))
 }
+
+func TestValue(t *testing.T) {
+	for _, order := range []Order{OrderABCD, OrderCDAB, OrderBADC, OrderDCBA} {
+		registers, err := EncodeValue(1.5, TypeFloat32, order, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := DecodeValue(registers, TypeFloat32, order)
+		if err != nil || value != float32(1.5) {
+			t.Error(order, value, err)
+		}
+	}
+	if r, _ := EncodeValue(1.5, TypeFloat32, OrderCDAB, 0); r[0] != 0x0000 || r[1] != 0x3FC0 {
+		t.Errorf("CDAB错误:%04x", r)
+	}
+	if v, _ := DecodeValue([]uint16{0xFFFF, 0xFFFE}, TypeInt32, OrderABCD); v != int32(-2) {
+		t.Error(v)
+	}
+	if v, _ := DecodeValue([]uint16{0x6162, 0x6300}, TypeString, OrderABCD); v != "abc" {
+		t.Error(v)
+	}
+	//整数直接编码,不经过float64
+	if r, err := EncodeValue(int64(1)<<53+1, TypeInt64, OrderABCD, 0); err != nil || r[3] != 1 {
+		t.Errorf("int64精度丢失:%04x %v", r, err)
+	}
+	if r, err := EncodeValue(uint64(math.MaxUint64), TypeUint64, OrderABCD, 0); err != nil || r[3] != 0xFFFF {
+		t.Errorf("uint64精度丢失:%04x %v", r, err)
+	}
+	if r, err := EncodeValue(-2, TypeInt16, OrderABCD, 0); err != nil || r[0] != 0xFFFE {
+		t.Errorf("负数编码错误:%04x %v", r, err)
+	}
+	for _, c := range []struct {
+		value interface{}
+		t     DataType
+	}{{70000, TypeInt16}, {-1, TypeUint16}, {32768, TypeInt16}, {-32769, TypeInt16}, {1e20, TypeInt64}, {math.NaN(), TypeInt32}} {
+		if _, err := EncodeValue(c.value, c.t, OrderABCD, 0); err == nil {
+			t.Error("超出范围应该返回错误", c.value, c.t)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	for _, c := range []struct {
+		s       string
+		key     string
+		address uint16
+	}{
+		{"4x40001", KeyHoldingRegisters, 0},
+		{"4X40010", KeyHoldingRegisters, 9},
+		{"4x400001", KeyHoldingRegisters, 0},
+		{"4x1", KeyHoldingRegisters, 0},
+		{"3x00005", KeyInputRegisters, 4},
+		{"0x00001", KeyOutputCoils, 0},
+		{"10001", KeyInputCoils, 0},
+		{"465536", KeyHoldingRegisters, 65535},
+		{"hr:100", KeyHoldingRegisters, 100},
+		{"co:7", KeyOutputCoils, 7},
+	} {
+		key, address, err := ParseAddress(c.s)
+		if err != nil || key != c.key || address != c.address {
+			t.Error(c.s, key, address, err)
+		}
+	}
+	for _, s := range []string{"", "2x0001", "4x0", "400000", "hr:-1", "abc", "4x465537"} {
+		if _, _, err := ParseAddress(s); err == nil {
+			t.Error("应返回错误:", s)
+		}
+	}
+	if s := FormatAddress(KeyHoldingRegisters, 0); s != "4x40001" {
+		t.Error(s)
+	}
+	if s := FormatAddress(KeyInputCoils, 9999); s != "1x110000" {
+		t.Error(s)
+	}
+}
@@ -0,0 +1,271 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	TypeBool    DataType = "bool"
+	TypeInt16   DataType = "int16"
+	TypeUint16  DataType = "uint16"
+	TypeInt32   DataType = "int32"
+	TypeUint32  DataType = "uint32"
+	TypeFloat32 DataType = "float32"
+	TypeInt64   DataType = "int64"
+	TypeUint64  DataType = "uint64"
+	TypeFloat64 DataType = "float64"
+	TypeString  DataType = "string"
+)
+
+const (
+	// OrderABCD 大端,高字在前,字内高字节在前(默认)
+	OrderABCD Order = "ABCD"
+
+	// OrderCDAB 低字在前,字内高字节在前
+	OrderCDAB Order = "CDAB"
+
+	// OrderBADC 高字在前,字内低字节在前
+	OrderBADC Order = "BADC"
+
+	// OrderDCBA 小端,低字在前,字内低字节在前
+	OrderDCBA Order = "DCBA"
+)
+
+// DataType 多个寄存器组成的数据类型
+type DataType string
+
+// Registers 数据类型占用的寄存器数量,字符串返回0,由长度决定
+func (this DataType) Registers() int {
+	switch this {
+	case TypeBool, TypeInt16, TypeUint16:
+		return 1
+	case TypeInt32, TypeUint32, TypeFloat32:
+		return 2
+	case TypeInt64, TypeUint64, TypeFloat64:
+		return 4
+	}
+	return 0
+}
+
+// Numeric 是否是数字类型
+func (this DataType) Numeric() bool {
+	return this.Registers() > 0 && this != TypeBool
+}
+
+// Order 多个寄存器组成数据时的字节顺序
+type Order string
+
+// bytes 按字节顺序把寄存器转成大端字节
+func (this Order) bytes(registers []uint16) []byte {
+	n := len(registers)
+	bs := make([]byte, 0, n*2)
+	for i := range registers {
+		r := registers[i]
+		if this == OrderCDAB || this == OrderDCBA {
+			r = registers[n-1-i]
+		}
+		if this == OrderBADC || this == OrderDCBA {
+			bs = append(bs, byte(r), byte(r>>8))
+		} else {
+			bs = append(bs, byte(r>>8), byte(r))
+		}
+	}
+	return bs
+}
+
+// registers 按字节顺序把大端字节转成寄存器,bytes字节数需要是偶数
+func (this Order) registers(bytes []byte) []uint16 {
+	n := len(bytes) / 2
+	list := make([]uint16, n)
+	for i := 0; i < n; i++ {
+		r := uint16(bytes[i*2])<<8 | uint16(bytes[i*2+1])
+		if this == OrderBADC || this == OrderDCBA {
+			r = r<<8 | r>>8
+		}
+		if this == OrderCDAB || this == OrderDCBA {
+			list[n-1-i] = r
+		} else {
+			list[i] = r
+		}
+	}
+	return list
+}
+
+// DecodeValue 寄存器转成对应类型的值,字符串去掉末尾的0
+func DecodeValue(registers []uint16, t DataType, order Order) (interface{}, error) {
+	if n := t.Registers(); n > 0 && len(registers) != n {
+		return nil, errors.New("寄存器数量错误:" + string(t))
+	}
+	bs := order.bytes(registers)
+	var u uint64
+	for _, b := range bs {
+		u = u<<8 | uint64(b)
+	}
+	switch t {
+	case TypeBool:
+		return u != 0, nil
+	case TypeInt16:
+		return int16(u), nil
+	case TypeUint16:
+		return uint16(u), nil
+	case TypeInt32:
+		return int32(u), nil
+	case TypeUint32:
+		return uint32(u), nil
+	case TypeFloat32:
+		return math.Float32frombits(uint32(u)), nil
+	case TypeInt64:
+		return int64(u), nil
+	case TypeUint64:
+		return u, nil
+	case TypeFloat64:
+		return math.Float64frombits(u), nil
+	case TypeString:
+		return strings.TrimRight(string(bs), "\x00"), nil
+	}
+	return nil, errors.New("未知数据类型:" + string(t))
+}
+
+// EncodeValue 值转成寄存器,字符串按length个寄存器补0
+func EncodeValue(value interface{}, t DataType, order Order, length int) ([]uint16, error) {
+	var u uint64
+	switch t {
+	case TypeString:
+		s, ok := value.(string)
+		if !ok || len(s) > length*2 {
+			return nil, errors.New("字符串长度错误")
+		}
+		bs := make([]byte, length*2)
+		copy(bs, s)
+		return order.registers(bs), nil
+	case TypeFloat32:
+		f, ok := toFloat(value)
+		if !ok {
+			return nil, errors.New("数据类型错误:" + string(t))
+		}
+		u = uint64(math.Float32bits(float32(f)))
+	case TypeFloat64:
+		f, ok := toFloat(value)
+		if !ok {
+			return nil, errors.New("数据类型错误:" + string(t))
+		}
+		u = math.Float64bits(f)
+	case TypeBool:
+		if b, ok := value.(bool); ok && b {
+			u = 1
+		}
+	default:
+		if t.Registers() == 0 {
+			return nil, errors.New("数据类型错误:" + string(t))
+		}
+		var err error
+		if u, err = encodeInteger(value, t); err != nil {
+			return nil, err
+		}
+	}
+	n := t.Registers()
+	bs := make([]byte, n*2)
+	for i := len(bs) - 1; i >= 0; i-- {
+		bs[i] = byte(u)
+		u >>= 8
+	}
+	return order.registers(bs), nil
+}
+
+// encodeInteger 整数按原值编码,不经过float64,超出数据类型的范围返回错误
+func encodeInteger(value interface{}, t DataType) (uint64, error) {
+	var i int64
+	var u uint64
+	neg := false
+	switch v := value.(type) {
+	case bool:
+		if v {
+			u = 1
+		}
+	case int:
+		i, neg, u = int64(v), v < 0, uint64(v)
+	case int8:
+		i, neg, u = int64(v), v < 0, uint64(v)
+	case int16:
+		i, neg, u = int64(v), v < 0, uint64(v)
+	case int32:
+		i, neg, u = int64(v), v < 0, uint64(v)
+	case int64:
+		i, neg, u = v, v < 0, uint64(v)
+	case uint:
+		u = uint64(v)
+	case uint8:
+		u = uint64(v)
+	case uint16:
+		u = uint64(v)
+	case uint32:
+		u = uint64(v)
+	case uint64:
+		u = v
+	case float32, float64:
+		//浮点数去掉小数部分
+		f, _ := toFloat(v)
+		f = math.Trunc(f)
+		switch {
+		case math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxUint64:
+			return 0, fmt.Errorf("数值%v超出%s的范围", value, t)
+		case f < 0:
+			i, neg, u = int64(f), true, uint64(int64(f))
+		default:
+			u = uint64(f)
+		}
+	default:
+		return 0, errors.New("数据类型错误:" + string(t))
+	}
+	bits := uint(t.Registers() * 16)
+	mask := ^uint64(0) >> (64 - bits)
+	max := mask
+	if t == TypeInt16 || t == TypeInt32 || t == TypeInt64 {
+		max >>= 1
+	} else if neg {
+		return 0, fmt.Errorf("数值%v超出%s的范围", value, t)
+	}
+	if (neg && i < -int64(max)-1) || (!neg && u > max) {
+		return 0, fmt.Errorf("数值%v超出%s的范围", value, t)
+	}
+	return u & mask, nil
+}
+
+// toFloat 数字转float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}